@@ -1,4 +1,6 @@
 set GOPATH=%~dp0%client
 echo %GOPATH%
 %GOROOT%\bin\go build gowalk
-copy client\gowalk.conf.default gowalk.conf
\ No newline at end of file
+%GOROOT%\bin\go build -o gowalk-server.exe .\server
+copy client\gowalk.conf.default gowalk.conf
+copy client\gfwlist.txt gfwlist.txt
\ No newline at end of file
@@ -1,3 +1,5 @@
 export GOPATH=$PWD/client
 $GOROOT/bin/go build gowalk
 cp ./client/gowalk.conf.default gowalk.conf
+cp ./client/gfwlist.txt gfwlist.txt
+$GOROOT/bin/go build -o gowalk-server ./server
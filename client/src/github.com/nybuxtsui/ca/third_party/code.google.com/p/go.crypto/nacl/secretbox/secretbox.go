@@ -18,8 +18,8 @@ This package is interoperable with NaCl: http://nacl.cr.yp.to/secretbox.html.
 package secretbox
 
 import (
-	"code.google.com/p/go.crypto/poly1305"
-	"code.google.com/p/go.crypto/salsa20/salsa"
+	"github.com/nybuxtsui/ca/third_party/code.google.com/p/go.crypto/poly1305"
+	"github.com/nybuxtsui/ca/third_party/code.google.com/p/go.crypto/salsa20/salsa"
 )
 
 // Overhead is the number of bytes of overhead when boxing a message.
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"log"
+	"time"
+)
+
+const (
+	// 批量请求里面自动分块的大小，避免批量应答过大
+	// 剩下的内容按照普通请求继续获取
+	batchRangeSize = 512 * 1024
+)
+
+// 等待合并发送的请求
+// ch返回应答，data和err都为nil表示没有合并发送，需要单独发送
+type batchReq struct {
+	data *HttpData
+	ch   chan batchResult
+}
+
+type batchResult struct {
+	data *HttpData
+	err  error
+}
+
+var batchCh = make(chan *batchReq, 100)
+
+// 请求是否可以合并发送，只合并没有body的小请求
+func batchable(data *HttpData, body []byte) bool {
+	if config.GoWalk.BatchWindow <= 0 || len(body) != 0 {
+		return false
+	}
+	return data.Method == "GET" || data.Method == "HEAD"
+}
+
+// 提交合并发送，请求需要已经签名
+func batchFetch(data *HttpData, cn <-chan bool) (*HttpData, error) {
+	req := &batchReq{data, make(chan batchResult, 1)}
+	batchCh <- req
+	select {
+	case res := <-req.ch:
+		return res.data, res.err
+	case <-cn:
+		return nil, ErrClosed
+	}
+}
+
+// 收集窗口时间内到达的请求，一起发送
+func batchWorker() {
+	window := time.Duration(config.GoWalk.BatchWindow) * time.Millisecond
+	max := config.GoWalk.BatchMax
+	if max <= 0 || max > maxBatchCount {
+		max = maxBatchCount
+	}
+	for {
+		reqs := []*batchReq{<-batchCh}
+		t := time.NewTimer(window)
+	collect:
+		for len(reqs) < max {
+			select {
+			case req := <-batchCh:
+				reqs = append(reqs, req)
+			case <-t.C:
+				break collect
+			}
+		}
+		t.Stop()
+		if len(reqs) == 1 {
+			// 只有一个请求，不需要合并
+			reqs[0].ch <- batchResult{}
+			continue
+		}
+		go sendBatch(reqs)
+	}
+}
+
+func sendBatch(reqs []*batchReq) {
+	var replied = make([]bool, len(reqs))
+	defer func() {
+		// 没有得到应答的请求，单独重新发送
+		for i, req := range reqs {
+			if !replied[i] {
+				req.ch <- batchResult{}
+			}
+		}
+	}()
+
+	var buff = new(bytes.Buffer)
+	var frame = new(bytes.Buffer)
+	writeBatchHead(buff, len(reqs))
+	for _, req := range reqs {
+		frame.Reset()
+		err := encode(req.data, frame, nil)
+		if err != nil {
+			log.Println("Encode batch failed:", err)
+			return
+		}
+		writeBatchFrame(buff, frame.Bytes())
+	}
+
+	// 批量请求也占用一个令牌
+	<-tokenCh
+	defer func() {
+		tokenCh <- 1
+	}()
+
+	resp, appid, err := postGAE(buff.Bytes(), 0, nil)
+	if err != nil {
+		log.Println("Batch fetch failed:", err)
+		return
+	}
+	defer resp.Body.Close()
+	r := bufio.NewReader(resp.Body)
+	count, err := readBatchHead(r)
+	if err != nil || count != len(reqs) {
+		log.Println("Decode batch failed:", appid, err)
+		return
+	}
+	for i := 0; i < count; i++ {
+		index, frame, err := readBatchReply(r, count)
+		if err != nil {
+			log.Println("Decode batch failed:", appid, err)
+			return
+		}
+		if len(frame) == 0 || replied[index] {
+			continue
+		}
+		data2, err := decode(bytes.NewReader(frame))
+		if err != nil {
+			log.Println("Decode batch failed:", appid, err)
+			continue
+		}
+		err = frameError(appid, data2)
+		if err != nil {
+			data2 = nil
+		}
+		replied[index] = true
+		reqs[index].ch <- batchResult{data2, err}
+	}
+}
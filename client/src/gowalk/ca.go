@@ -75,7 +75,7 @@ func newCert(host string) (pair *certKeyPair, err error) {
 		log.Println("Create CSR failed:", err)
 		return nil, err
 	}
-	info := &pkix.CertificateAuthorityInfo{big.NewInt(certserid)}
+	info := &pkix.CertificateAuthorityInfo{SerialNumber: big.NewInt(certserid)}
 	certserid++
 	capair := loadCA()
 	crtHost, err := pkix.CreateCertificateHost(capair.cert, info, capair.key, csr)
@@ -150,12 +150,12 @@ func loadCA() *certKeyPair {
 		var err error
 		c, err := depot.GetCertificateAuthority(certLib)
 		if err != nil {
-			log.Fatal("LoadCA|GetCertificateAuthority|%v", err)
+			log.Fatalf("LoadCA|GetCertificateAuthority|%v", err)
 			return nil
 		}
 		k, err := depot.GetEncryptedPrivateKeyAuthority(certLib, passphrase)
 		if err != nil {
-			log.Fatal("LoadCA|GetEncryptedPrivateKeyAuthority|%v", err)
+			log.Fatalf("LoadCA|GetEncryptedPrivateKeyAuthority|%v", err)
 			return nil
 		}
 		capair = &certKeyPair{c, k}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 可以缓存的应答状态码
+var cacheableStatus = map[int]bool{
+	200: true,
+	203: true,
+	206: true,
+	301: true,
+	404: true,
+	410: true,
+}
+
+func parseCacheControl(h http.Header) map[string]string {
+	cc := make(map[string]string)
+	for _, v := range h["Cache-Control"] {
+		for _, d := range strings.Split(v, ",") {
+			kv := strings.SplitN(strings.TrimSpace(d), "=", 2)
+			if kv[0] == "" {
+				continue
+			}
+			k := strings.ToLower(kv[0])
+			if len(kv) == 2 {
+				cc[k] = strings.Trim(kv[1], `"`)
+			} else {
+				cc[k] = ""
+			}
+		}
+	}
+	return cc
+}
+
+// 应答的有效期，不能缓存时返回false，参考RFC 7234 3和4.2
+// 按共享缓存处理，只缓存公开的应答，请求带有Authorization时应答需要明确为public
+// 应答长度未知或者超过maxSize时不缓存
+func freshness(req *http.Request, resp *http.Response, now time.Time, maxSize int64) (time.Duration, bool) {
+	if !cacheableStatus[resp.StatusCode] || resp.Header.Get("Set-Cookie") != "" {
+		return 0, false
+	}
+	if resp.ContentLength < 0 || resp.ContentLength > maxSize {
+		return 0, false
+	}
+	for _, v := range resp.Header["Vary"] {
+		if strings.TrimSpace(v) == "*" {
+			return 0, false
+		}
+	}
+	cc := parseCacheControl(resp.Header)
+	for _, k := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := cc[k]; ok {
+			return 0, false
+		}
+	}
+	_, public := cc["public"]
+	_, smaxage := cc["s-maxage"]
+	if req.Header.Get("Authorization") != "" && !public && !smaxage {
+		return 0, false
+	}
+	for _, k := range []string{"s-maxage", "max-age"} {
+		if v, ok := cc[k]; ok {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return 0, false
+			}
+			return time.Duration(n) * time.Second, true
+		}
+	}
+	if v := resp.Header.Get("Expires"); v != "" {
+		expires, err := http.ParseTime(v)
+		if err != nil {
+			// 无效的Expires表示已经过期
+			return 0, true
+		}
+		date, err := http.ParseTime(resp.Header.Get("Date"))
+		if err != nil {
+			date = now
+		}
+		return expires.Sub(date), true
+	}
+	return 0, false
+}
+
+// 只缓存GET，请求要求no-store时不使用缓存
+func cacheableRequest(req *http.Request) bool {
+	if req.Method != "GET" {
+		return false
+	}
+	_, noStore := parseCacheControl(req.Header)["no-store"]
+	return !noStore
+}
+
+// 请求要求向目标网站验证，比如浏览器的刷新
+func mustRevalidate(req *http.Request) bool {
+	cc := parseCacheControl(req.Header)
+	if _, ok := cc["no-cache"]; ok {
+		return true
+	}
+	if v, ok := cc["max-age"]; ok && v == "0" {
+		return true
+	}
+	return req.Header.Get("Pragma") == "no-cache"
+}
+
+// 应答的Vary列出的请求头部和对应的值
+func varyValues(req *http.Request, resp *http.Response) map[string]string {
+	vary := make(map[string]string)
+	for _, v := range resp.Header["Vary"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = http.CanonicalHeaderKey(strings.TrimSpace(name)); name != "" {
+				vary[name] = strings.Join(req.Header[name], ",")
+			}
+		}
+	}
+	return vary
+}
+
+func matchVary(vary map[string]string, req *http.Request) bool {
+	for name, value := range vary {
+		if strings.Join(req.Header[name], ",") != value {
+			return false
+		}
+	}
+	return true
+}
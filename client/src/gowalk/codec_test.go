@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func encodeFrame(t *testing.T, data *HttpData) []byte {
+	var buff bytes.Buffer
+	if err := encode(data, &buff, nil); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	return buff.Bytes()
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	big := bytes.Repeat([]byte("0123456789abcdef"), 3*maxChunkSize/16+7)
+	tests := []struct {
+		name string
+		data *HttpData
+		body []byte
+	}{
+		{"empty", &HttpData{}, nil},
+		{"request", &HttpData{
+			Method:          "GET",
+			Url:             "https://www.example.com/a?b=c",
+			Header:          http.Header{"Accept": {"*/*"}, "X-Multi": {"1", "2"}},
+			Timestamp:       1500000000,
+			Nonce:           "0123456789abcdef",
+			Signature:       "sig",
+			CompressMinSize: 2048,
+			CompressLevel:   6,
+			AutoRange:       true,
+			Parallel:        4,
+		}, []byte("post body")},
+		{"response", &HttpData{
+			Status:   206,
+			Header:   http.Header{"Content-Type": {"text/plain"}},
+			CacheHit: true,
+		}, big},
+		{"error", &HttpData{Error: ErrorTooLarge, ErrorMsg: "too large"}, nil},
+		{"user", &HttpData{User: "alice", Method: "GET", Url: "http://a/"}, nil},
+	}
+	for _, tt := range tests {
+		data := *tt.data
+		if data.Header == nil {
+			data.Header = make(http.Header)
+		}
+		if tt.body != nil {
+			data.Body = ioutil.NopCloser(bytes.NewReader(tt.body))
+		}
+		frame := encodeFrame(t, &data)
+		got, err := decode(bytes.NewReader(frame))
+		if err != nil {
+			t.Errorf("%s: decode: %v", tt.name, err)
+			continue
+		}
+		body, err := ioutil.ReadAll(got.Body)
+		if err != nil {
+			t.Errorf("%s: read body: %v", tt.name, err)
+			continue
+		}
+		if !bytes.Equal(body, tt.body) {
+			t.Errorf("%s: body %d bytes, want %d", tt.name, len(body), len(tt.body))
+		}
+		got.Body = nil
+		data.Body = nil
+		if !reflect.DeepEqual(got, &data) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, &data)
+		}
+	}
+}
+
+func TestCodecFlags(t *testing.T) {
+	tests := []struct {
+		name  string
+		data  *HttpData
+		flags byte
+	}{
+		{"small", &HttpData{Header: http.Header{"Content-Length": {"10"}}}, 0},
+		{"text", &HttpData{Header: http.Header{"Content-Type": {"text/html"}}}, flagGzip},
+		{"image", &HttpData{Header: http.Header{"Content-Type": {"image/png"}}}, 0},
+		{"encoded", &HttpData{Header: http.Header{"Content-Encoding": {"gzip"}}}, 0},
+		{"user", &HttpData{User: "bob", Header: http.Header{"Content-Length": {"10"}}}, flagUser},
+	}
+	for _, tt := range tests {
+		frame := encodeFrame(t, tt.data)
+		if string(frame[:2]) != frameMagic || frame[2] != protocolVersion {
+			t.Errorf("%s: bad head % x", tt.name, frame[:4])
+		}
+		if frame[3] != tt.flags {
+			t.Errorf("%s: flags %#x, want %#x", tt.name, frame[3], tt.flags)
+		}
+	}
+}
+
+func TestCodecBadFrame(t *testing.T) {
+	data := &HttpData{Method: "GET", Url: "http://a/", Header: make(http.Header)}
+	data.Body = ioutil.NopCloser(bytes.NewReader([]byte("body")))
+	frame := encodeFrame(t, data)
+
+	version := append([]byte(nil), frame...)
+	version[2] = protocolVersion + 1
+	if _, err := decode(bytes.NewReader(version)); err == nil {
+		t.Error("version mismatch: no error")
+	} else if e, ok := err.(*VersionError); !ok || e.Version != protocolVersion+1 {
+		t.Errorf("version mismatch: %v", err)
+	}
+
+	for name, b := range map[string][]byte{
+		"magic":      append([]byte("XX"), frame[2:]...),
+		"both flags": append([]byte{'G', 'W', protocolVersion, flagGzip | flagDeflate}, frame[4:]...),
+		"bad flag":   append([]byte{'G', 'W', protocolVersion, 0x80}, frame[4:]...),
+	} {
+		if _, err := decode(bytes.NewReader(b)); err != ErrFormat {
+			t.Errorf("%s: %v, want ErrFormat", name, err)
+		}
+	}
+
+	// 任何位置截断都不能当作完整的帧
+	for i := 0; i < len(frame); i++ {
+		got, err := decode(bytes.NewReader(frame[:i]))
+		if err == nil {
+			_, err = ioutil.ReadAll(got.Body)
+		}
+		if err == nil {
+			t.Errorf("truncated at %d: no error", i)
+		}
+	}
+}
+
+func TestCodecDigest(t *testing.T) {
+	body := []byte("digest body")
+	sum := sha256.Sum256(body)
+	for _, tt := range []struct {
+		digest string
+		err    error
+	}{
+		{string(sum[:]), nil},
+		{"wrong", ErrDigest},
+	} {
+		data := &HttpData{Status: 200, Header: make(http.Header), Digest: tt.digest}
+		data.Body = ioutil.NopCloser(bytes.NewReader(body))
+		got, err := decode(bytes.NewReader(encodeFrame(t, data)))
+		if err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		if _, err = ioutil.ReadAll(got.Body); err != tt.err {
+			t.Errorf("digest %q: %v, want %v", tt.digest, err, tt.err)
+		}
+	}
+}
+
+func TestBatchFraming(t *testing.T) {
+	var buff bytes.Buffer
+	writeBatchHead(&buff, 2)
+	writeBatchReply(&buff, 1, []byte("second"))
+	writeBatchReply(&buff, 0, nil)
+	r := bufio.NewReader(&buff)
+	if !isBatch(r) {
+		t.Fatal("isBatch false")
+	}
+	count, err := readBatchHead(r)
+	if err != nil || count != 2 {
+		t.Fatalf("head: %d %v", count, err)
+	}
+	for _, want := range []struct {
+		index int
+		frame string
+	}{{1, "second"}, {0, ""}} {
+		index, frame, err := readBatchReply(r, count)
+		if err != nil || index != want.index || string(frame) != want.frame {
+			t.Errorf("reply: %d %q %v, want %d %q", index, frame, err, want.index, want.frame)
+		}
+	}
+	if _, _, err := readBatchReply(r, count); err != io.ErrUnexpectedEOF {
+		t.Errorf("after last reply: %v", err)
+	}
+
+	buff.Reset()
+	writeBatchHead(&buff, 1)
+	writeBatchReply(&buff, 3, []byte("x"))
+	r = bufio.NewReader(&buff)
+	readBatchHead(r)
+	if _, _, err := readBatchReply(r, 1); err != ErrFormat {
+		t.Errorf("index out of range: %v", err)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"mime"
+	"strconv"
+	"strings"
+)
+
+const (
+	// body小于这个长度时不压缩，压缩的收益抵不过开销
+	defaultCompressMinSize = 1024
+)
+
+// 本身已经压缩过的内容，再压缩只是浪费CPU
+var incompressibleTypes = []string{
+	"image/",
+	"video/",
+	"audio/",
+	"font/woff",
+	"application/font-woff",
+	"application/zip",
+	"application/gzip",
+	"application/x-gzip",
+	"application/x-bzip2",
+	"application/x-xz",
+	"application/x-7z-compressed",
+	"application/x-rar-compressed",
+	"application/pdf",
+}
+
+// 仍然是文本的image类型
+var compressibleImages = []string{
+	"image/svg+xml",
+	"image/x-icon",
+	"image/bmp",
+}
+
+// 根据Content-Encoding, Content-Type和长度选择压缩方式
+// 加密后有poly1305校验，不需要gzip的crc，所以用deflate
+func chooseCompression(data *HttpData, sealed bool) byte {
+	if ce := data.Header.Get("Content-Encoding"); ce != "" && ce != "identity" {
+		return 0
+	}
+	minSize := data.CompressMinSize
+	if minSize == 0 {
+		minSize = defaultCompressMinSize
+	}
+	if cl := data.Header.Get("Content-Length"); cl != "" {
+		size, err := strconv.ParseInt(cl, 10, 64)
+		if err == nil && size < int64(minSize) {
+			return 0
+		}
+	}
+	if ct := data.Header.Get("Content-Type"); ct != "" {
+		mt, _, err := mime.ParseMediaType(ct)
+		if err == nil && isIncompressible(mt) {
+			return 0
+		}
+	}
+	if sealed {
+		return flagDeflate
+	}
+	return flagGzip
+}
+
+func isIncompressible(mt string) bool {
+	for _, t := range compressibleImages {
+		if mt == t {
+			return false
+		}
+	}
+	for _, t := range incompressibleTypes {
+		if strings.HasPrefix(mt, t) {
+			return true
+		}
+	}
+	return false
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// 压缩级别限制在1-9，0或者负数为默认级别
+// 级别来自配置或者对端的帧，超出范围时gzip和flate都会返回错误
+func clampCompressLevel(level int) int {
+	switch {
+	case level <= 0:
+		return 0
+	case level < flate.BestSpeed:
+		return flate.BestSpeed
+	case level > flate.BestCompression:
+		return flate.BestCompression
+	}
+	return level
+}
+
+func newCompressWriter(w io.Writer, compression byte, level int) (io.WriteCloser, error) {
+	level = clampCompressLevel(level)
+	if level == 0 {
+		level = flate.DefaultCompression
+	}
+	switch compression {
+	case flagGzip:
+		return gzip.NewWriterLevel(w, level)
+	case flagDeflate:
+		return flate.NewWriter(w, level)
+	}
+	return nopWriteCloser{w}, nil
+}
+
+func newDecompressReader(r io.Reader, compression byte) (io.ReadCloser, error) {
+	switch compression {
+	case flagGzip:
+		return gzip.NewReader(r)
+	case flagDeflate:
+		return flate.NewReader(r), nil
+	}
+	return ioutil.NopCloser(r), nil
+}
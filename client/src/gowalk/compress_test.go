@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+func TestCompressLevel(t *testing.T) {
+	for _, tt := range []struct {
+		level, want int
+	}{
+		{-3, 0},
+		{0, 0},
+		{1, 1},
+		{6, 6},
+		{9, 9},
+		{42, 9},
+	} {
+		if got := clampCompressLevel(tt.level); got != tt.want {
+			t.Errorf("clampCompressLevel(%d) = %d, want %d", tt.level, got, tt.want)
+		}
+		// 超出范围的级别也能正常压缩
+		for _, c := range []byte{flagGzip, flagDeflate} {
+			data := &HttpData{Status: 200, Header: http.Header{"Content-Type": {"text/plain"}}, CompressLevel: tt.level}
+			body := bytes.Repeat([]byte("compress "), 1000)
+			data.Body = ioutil.NopCloser(bytes.NewReader(body))
+			var buff bytes.Buffer
+			zw, err := newCompressWriter(&buff, c, tt.level)
+			if err != nil {
+				t.Errorf("level %d flag %d: %v", tt.level, c, err)
+				continue
+			}
+			zw.Close()
+			frame := encodeFrame(t, data)
+			got, err := decode(bytes.NewReader(frame))
+			if err != nil {
+				t.Fatalf("level %d: %v", tt.level, err)
+			}
+			if b, err := ioutil.ReadAll(got.Body); err != nil || !bytes.Equal(b, body) {
+				t.Errorf("level %d: body %d bytes, %v", tt.level, len(b), err)
+			}
+		}
+	}
+}
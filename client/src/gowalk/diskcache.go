@@ -0,0 +1,520 @@
+package main
+
+import (
+	"bufio"
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// 单个应答最大为缓存总大小的1/16
+	diskCacheEntryRatio = 16
+	// 文件开头保存元数据长度的字节数
+	diskCacheMetaLen = 4
+)
+
+/*
+客户端的磁盘缓存，在GAE之前，命中时不消耗GAE的流量
+规则和服务器端的缓存一样，参考cachectl.go，每个URL只保存一个版本
+文件名为URL的sha256，内容为 元数据长度(4) + gob编码的元数据 + body
+按最近使用的顺序淘汰，启动时按文件的修改时间恢复顺序
+*/
+type diskEntry struct {
+	Url     string
+	Status  int
+	Header  http.Header
+	Vary    map[string]string
+	Stored  time.Time
+	Expires time.Time
+}
+
+type diskItem struct {
+	key  string
+	size int64
+}
+
+type diskCache struct {
+	dir string
+	max int64
+
+	lock  sync.Mutex
+	size  int64
+	lru   *list.List
+	items map[string]*list.Element
+}
+
+var httpCache *diskCache
+
+func newDiskCache(dir string, max int64) (*diskCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	c := &diskCache{dir: dir, max: max, lru: list.New(), items: make(map[string]*list.Element)}
+	sort.Sort(byModTime(files))
+	for _, f := range files {
+		if len(f.Name()) != sha256.Size*2 || f.IsDir() {
+			// 上次没有写完的临时文件
+			os.Remove(filepath.Join(dir, f.Name()))
+			continue
+		}
+		c.items[f.Name()] = c.lru.PushFront(&diskItem{f.Name(), f.Size()})
+		c.size += f.Size()
+	}
+	c.lock.Lock()
+	c.evict()
+	c.lock.Unlock()
+	return c, nil
+}
+
+type byModTime []os.FileInfo
+
+func (s byModTime) Len() int           { return len(s) }
+func (s byModTime) Less(i, j int) bool { return s[i].ModTime().Before(s[j].ModTime()) }
+func (s byModTime) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func diskCacheKey(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *diskCache) path(key string) string {
+	return filepath.Join(c.dir, key)
+}
+
+func (c *diskCache) maxEntry() int64 {
+	return c.max / diskCacheEntryRatio
+}
+
+// 需要持有lock
+func (c *diskCache) evict() {
+	for c.size > c.max {
+		e := c.lru.Back()
+		if e == nil {
+			return
+		}
+		c.removeElement(e)
+	}
+}
+
+// 需要持有lock
+func (c *diskCache) removeElement(e *list.Element) {
+	item := e.Value.(*diskItem)
+	c.lru.Remove(e)
+	delete(c.items, item.key)
+	c.size -= item.size
+	os.Remove(c.path(item.key))
+}
+
+func (c *diskCache) touch(key string) {
+	c.lock.Lock()
+	if e, ok := c.items[key]; ok {
+		c.lru.MoveToFront(e)
+	}
+	c.lock.Unlock()
+	now := time.Now()
+	os.Chtimes(c.path(key), now, now)
+}
+
+// 写完的临时文件改名为正式的文件
+func (c *diskCache) commit(key string, tmp string, size int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	// Windows上旧文件还打开着的时候改名会失败，改名成功之后才移除旧的项
+	if err := os.Rename(tmp, c.path(key)); err != nil {
+		log.Println("Commit cache failed:", err)
+		os.Remove(tmp)
+		return
+	}
+	if e, ok := c.items[key]; ok {
+		c.lru.Remove(e)
+		c.size -= e.Value.(*diskItem).size
+	}
+	c.items[key] = c.lru.PushFront(&diskItem{key, size})
+	c.size += size
+	c.evict()
+}
+
+func (c *diskCache) remove(key string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if e, ok := c.items[key]; ok {
+		c.removeElement(e)
+		return true
+	}
+	return false
+}
+
+func (c *diskCache) purge() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	n := c.lru.Len()
+	for c.lru.Len() > 0 {
+		c.removeElement(c.lru.Back())
+	}
+	return n
+}
+
+// 打开缓存文件，返回的文件已经读到body开始的位置
+func (c *diskCache) load(key string) (*diskEntry, *os.File, int64) {
+	f, err := os.Open(c.path(key))
+	if err != nil {
+		return nil, nil, 0
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, 0
+	}
+	var head [diskCacheMetaLen]byte
+	if _, err = io.ReadFull(f, head[:]); err == nil {
+		size := int64(binary.BigEndian.Uint32(head[:]))
+		var entry diskEntry
+		if err = gob.NewDecoder(bufio.NewReader(io.LimitReader(f, size))).Decode(&entry); err == nil {
+			if _, err = f.Seek(diskCacheMetaLen+size, io.SeekStart); err == nil {
+				return &entry, f, info.Size() - diskCacheMetaLen - size
+			}
+		}
+	}
+	log.Println("Load cache failed:", key, err)
+	f.Close()
+	c.remove(key)
+	return nil, nil, 0
+}
+
+// 创建临时文件并写入元数据
+func (c *diskCache) create(entry *diskEntry) (*os.File, error) {
+	f, err := ioutil.TempFile(c.dir, "tmp")
+	if err != nil {
+		return nil, err
+	}
+	var meta bufferWriter
+	if err = gob.NewEncoder(&meta).Encode(entry); err == nil {
+		var head [diskCacheMetaLen]byte
+		binary.BigEndian.PutUint32(head[:], uint32(len(meta)))
+		if _, err = f.Write(head[:]); err == nil {
+			_, err = f.Write(meta)
+		}
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return f, nil
+}
+
+type bufferWriter []byte
+
+func (b *bufferWriter) Write(p []byte) (int, error) {
+	*b = append(*b, p...)
+	return len(p), nil
+}
+
+func cloneHeader(h http.Header) http.Header {
+	h2 := make(http.Header, len(h))
+	for k, v := range h {
+		h2[k] = append([]string(nil), v...)
+	}
+	return h2
+}
+
+func hasValidator(h http.Header) bool {
+	return h.Get("ETag") != "" || h.Get("Last-Modified") != ""
+}
+
+// 浏览器的条件请求，缓存的内容没有变化时返回304，参考RFC 7232 6
+func notModified(r *http.Request, h http.Header) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		etag := h.Get("ETag")
+		return etag != "" && inm == etag
+	}
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lm, err := http.ParseTime(h.Get("Last-Modified"))
+	return err == nil && !lm.After(ims)
+}
+
+// 用缓存的内容应答浏览器
+func (c *diskCache) write(w http.ResponseWriter, r *http.Request, entry *diskEntry, f *os.File, size int64, now time.Time) {
+	h := w.Header()
+	for k, v := range entry.Header {
+		h[k] = v
+	}
+	age := int64(now.Sub(entry.Stored) / time.Second)
+	if v, err := strconv.ParseInt(h.Get("Age"), 10, 64); err == nil {
+		age += v
+	}
+	h.Set("Age", strconv.FormatInt(age, 10))
+	h.Set("X-Cache", "HIT from gowalk disk")
+	if notModified(r, entry.Header) {
+		h.Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	h.Set("Content-Length", strconv.FormatInt(size, 10))
+	w.WriteHeader(entry.Status)
+	io.Copy(w, f)
+}
+
+// 重新验证之后用304的头部更新缓存，body复制到新文件
+// 复制完之后关闭f再提交，Windows上不能改名覆盖打开的文件
+func (c *diskCache) refresh(key string, entry *diskEntry, f *os.File, size int64) {
+	out, err := c.create(entry)
+	if err != nil {
+		log.Println("Create cache failed:", err)
+		return
+	}
+	n, err := io.Copy(out, f)
+	f.Close()
+	var info os.FileInfo
+	if err == nil {
+		info, err = out.Stat()
+	}
+	out.Close()
+	if err != nil || n != size {
+		os.Remove(out.Name())
+		return
+	}
+	c.commit(key, out.Name(), info.Size())
+}
+
+/*
+缓存的内容没有过期时直接返回
+过期的内容有ETag或者Last-Modified时，带上If-None-Match和If-Modified-Since通过fetch获取，返回304时继续使用缓存
+浏览器自己带了条件请求时原样转发，可以缓存的应答在返回浏览器的同时写入缓存
+*/
+func (c *diskCache) serve(w http.ResponseWriter, r *http.Request, fetch func(http.ResponseWriter, *http.Request) bool) {
+	now := time.Now()
+	url := requestUrl(r)
+	key := diskCacheKey(url)
+	entry, f, size := c.load(key)
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+	}()
+	if entry != nil && (entry.Url != url || !matchVary(entry.Vary, r)) {
+		entry = nil
+	}
+	if entry != nil && now.Before(entry.Expires) && !mustRevalidate(r) {
+		log.Println("Disk cache hit:", url)
+		c.touch(key)
+		c.write(w, r, entry, f, size, now)
+		return
+	}
+
+	// Vary按照浏览器原来的请求头部计算
+	orig := &http.Request{Method: r.Method, URL: r.URL, Header: cloneHeader(r.Header)}
+	validating := false
+	if entry != nil && hasValidator(entry.Header) && r.Header.Get("If-None-Match") == "" && r.Header.Get("If-Modified-Since") == "" {
+		if etag := entry.Header.Get("ETag"); etag != "" {
+			r.Header.Set("If-None-Match", etag)
+		}
+		if lm := entry.Header.Get("Last-Modified"); lm != "" {
+			r.Header.Set("If-Modified-Since", lm)
+		}
+		validating = true
+	}
+	cw := &cacheWriter{w: w, header: make(http.Header), c: c, req: orig, url: url, validating: validating, now: now}
+	complete := fetch(cw, r)
+	if cw.notModified {
+		// 内容没有变化，用304的头部更新缓存的头部和有效期
+		for k, v := range cw.header {
+			if k != "Content-Length" {
+				entry.Header[k] = v
+			}
+		}
+		cached := &http.Response{StatusCode: entry.Status, Header: entry.Header, ContentLength: size}
+		if ttl, ok := freshness(orig, cached, now, c.maxEntry()); ok {
+			entry.Expires = now.Add(ttl)
+		}
+		entry.Stored = now
+		log.Println("Disk cache revalidated:", url)
+		c.write(w, orig, entry, f, size, now)
+		if _, err := f.Seek(-size, io.SeekEnd); err == nil {
+			c.refresh(key, entry, f, size)
+			f = nil
+		}
+		return
+	}
+	// 旧的缓存文件不再需要，提交新的内容之前关闭
+	if f != nil {
+		f.Close()
+		f = nil
+	}
+	cw.finish(key, complete)
+}
+
+// 获取时使用的ResponseWriter，可以缓存的应答同时写入临时文件
+type cacheWriter struct {
+	w      http.ResponseWriter
+	header http.Header
+	c      *diskCache
+	req    *http.Request
+	url    string
+	now    time.Time
+
+	validating  bool
+	notModified bool
+	wroteHeader bool
+	file        *os.File
+	length      int64
+	written     int64
+}
+
+func (cw *cacheWriter) Header() http.Header {
+	return cw.header
+}
+
+func (cw *cacheWriter) CloseNotify() <-chan bool {
+	return cw.w.(http.CloseNotifier).CloseNotify()
+}
+
+func (cw *cacheWriter) WriteHeader(status int) {
+	if cw.wroteHeader {
+		return
+	}
+	cw.wroteHeader = true
+	if cw.validating && status == http.StatusNotModified {
+		cw.notModified = true
+		return
+	}
+	length, err := strconv.ParseInt(cw.header.Get("Content-Length"), 10, 64)
+	if err != nil {
+		length = -1
+	}
+	// 长度未知时在写入的时候检查大小
+	resp := &http.Response{StatusCode: status, Header: cw.header, ContentLength: length}
+	if length < 0 {
+		resp.ContentLength = 0
+	}
+	if ttl, ok := freshness(cw.req, resp, cw.now, cw.c.maxEntry()); ok && (ttl > 0 || hasValidator(cw.header)) {
+		header := cloneHeader(cw.header)
+		header.Del("X-Cache")
+		entry := &diskEntry{
+			Url:     cw.url,
+			Status:  status,
+			Header:  header,
+			Vary:    varyValues(cw.req, resp),
+			Stored:  cw.now,
+			Expires: cw.now.Add(ttl),
+		}
+		if cw.file, err = cw.c.create(entry); err != nil {
+			log.Println("Create cache failed:", err)
+		}
+		cw.length = length
+	}
+	h := cw.w.Header()
+	for k, v := range cw.header {
+		h[k] = v
+	}
+	cw.w.WriteHeader(status)
+}
+
+func (cw *cacheWriter) Write(b []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.notModified {
+		return len(b), nil
+	}
+	if cw.file != nil {
+		if _, err := cw.file.Write(b); err != nil {
+			log.Println("Write cache failed:", err)
+			cw.discard()
+		}
+		cw.written += int64(len(b))
+		if cw.file != nil && cw.written > cw.c.maxEntry() {
+			cw.discard()
+		}
+	}
+	return cw.w.Write(b)
+}
+
+func (cw *cacheWriter) discard() {
+	cw.file.Close()
+	os.Remove(cw.file.Name())
+	cw.file = nil
+}
+
+// 完整收到应答之后才写入缓存
+func (cw *cacheWriter) finish(key string, complete bool) {
+	if cw.file == nil {
+		return
+	}
+	if !complete || (cw.length >= 0 && cw.written != cw.length) {
+		cw.discard()
+		return
+	}
+	info, err := cw.file.Stat()
+	if err != nil {
+		cw.discard()
+		return
+	}
+	cw.file.Close()
+	cw.c.commit(key, cw.file.Name(), info.Size())
+}
+
+// 是否经过磁盘缓存，规则里面可以单独打开或者关闭
+func useDiskCache(r *http.Request, rule *rule) bool {
+	if httpCache == nil || !cacheableRequest(r) || r.Header.Get("Range") != "" {
+		return false
+	}
+	return rule.Cache == nil || *rule.Cache
+}
+
+// 清除缓存时必须带的头部
+// 网页跨域发送自定义头部之前浏览器要先发OPTIONS预检，gowalk不应答CORS，网页不能替用户清除缓存
+const purgeHeader = "X-Gowalk-Purge"
+
+// 清除缓存，POST /_~_/cache/purge 清除所有缓存，带url参数时只清除这个URL
+// 比如 curl -X POST -H "X-Gowalk-Purge: 1" http://127.0.0.1:18087/_~_/cache/purge
+func cachePurgePage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "usage: POST /_~_/cache/purge[?url=...] with header "+purgeHeader+": 1", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.Header.Get(purgeHeader) == "" {
+		http.Error(w, "missing header "+purgeHeader, http.StatusForbidden)
+		return
+	}
+	if httpCache == nil {
+		http.Error(w, "disk cache is disabled", http.StatusNotFound)
+		return
+	}
+	n := 0
+	if url := r.URL.Query().Get("url"); url != "" {
+		if httpCache.remove(diskCacheKey(url)) {
+			n = 1
+		}
+	} else {
+		n = httpCache.purge()
+	}
+	httpCache.lock.Lock()
+	size := httpCache.size
+	httpCache.lock.Unlock()
+	log.Println("Purge disk cache:", n)
+	fmt.Fprintf(w, "purged %d entries, %d bytes left\n", n, size)
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+)
+
+func tempDiskCache(t *testing.T, max int64) (*diskCache, func()) {
+	dir, err := ioutil.TempDir("", "diskcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := newDiskCache(dir, max)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return c, func() { os.RemoveAll(dir) }
+}
+
+// 模拟的fetch，记录收到的请求，按header和body应答
+type fakeOrigin struct {
+	status int
+	header http.Header
+	body   []byte
+	calls  int
+	last   *http.Request
+}
+
+func (o *fakeOrigin) fetch(w http.ResponseWriter, r *http.Request) bool {
+	o.calls++
+	o.last = r
+	for k, v := range o.header {
+		w.Header()[k] = v
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(o.body)))
+	w.WriteHeader(o.status)
+	w.Write(o.body)
+	return true
+}
+
+func cacheGet(c *diskCache, url string, fetch func(http.ResponseWriter, *http.Request) bool) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	c.serve(w, httptest.NewRequest("GET", url, nil), fetch)
+	return w
+}
+
+func TestDiskCacheLRU(t *testing.T) {
+	c, cleanup := tempDiskCache(t, 16*1024)
+	defer cleanup()
+	origin := &fakeOrigin{status: 200, header: http.Header{"Cache-Control": {"max-age=600"}}, body: bytes.Repeat([]byte("x"), 900)}
+	url := func(i int) string { return "http://www.example.com/" + strconv.Itoa(i) }
+	for i := 0; i < 30; i++ {
+		cacheGet(c, url(i), origin.fetch)
+		// 第一个一直在使用，不会被淘汰
+		cacheGet(c, url(0), origin.fetch)
+		if c.size > c.max {
+			t.Fatalf("size %d over %d", c.size, c.max)
+		}
+	}
+	if origin.calls != 30 {
+		t.Errorf("%d fetches, want 30", origin.calls)
+	}
+	if _, ok := c.items[diskCacheKey(url(0))]; !ok {
+		t.Error("recently used entry evicted")
+	}
+	if _, ok := c.items[diskCacheKey(url(1))]; ok {
+		t.Error("least recently used entry kept")
+	}
+	if _, ok := c.items[diskCacheKey(url(29))]; !ok {
+		t.Error("newest entry evicted")
+	}
+
+	// 重新打开时恢复大小和内容
+	c2, err := newDiskCache(c.dir, c.max)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c2.size != c.size || c2.lru.Len() != c.lru.Len() {
+		t.Errorf("reopen: %d bytes %d entries, want %d %d", c2.size, c2.lru.Len(), c.size, c.lru.Len())
+	}
+	if w := cacheGet(c2, url(29), origin.fetch); w.Header().Get("X-Cache") == "" || w.Body.Len() != 900 {
+		t.Errorf("reopen: not served from cache")
+	}
+
+	// 超过总大小1/16的应答不缓存
+	origin.body = bytes.Repeat([]byte("x"), int(c.maxEntry())+1)
+	cacheGet(c, url(100), origin.fetch)
+	if _, ok := c.items[diskCacheKey(url(100))]; ok {
+		t.Error("entry over maxEntry cached")
+	}
+}
+
+func TestDiskCacheRevalidate(t *testing.T) {
+	c, cleanup := tempDiskCache(t, 1024*1024)
+	defer cleanup()
+	const url = "http://www.example.com/etag"
+	origin := &fakeOrigin{status: 200, header: http.Header{"Cache-Control": {"max-age=0"}, "Etag": {`"v1"`}}, body: []byte("version 1")}
+	cacheGet(c, url, origin.fetch)
+
+	// 过期之后带上If-None-Match，304时用缓存的内容应答
+	origin.status = 304
+	origin.body = nil
+	w := cacheGet(c, url, origin.fetch)
+	if origin.last.Header.Get("If-None-Match") != `"v1"` {
+		t.Errorf("If-None-Match %q", origin.last.Header.Get("If-None-Match"))
+	}
+	if w.Code != 200 || w.Body.String() != "version 1" || w.Header().Get("X-Cache") == "" {
+		t.Errorf("revalidated: %d %q", w.Code, w.Body.String())
+	}
+
+	// 浏览器自己的条件请求原样转发
+	r := httptest.NewRequest("GET", url, nil)
+	r.Header.Set("If-None-Match", `"v0"`)
+	w = httptest.NewRecorder()
+	c.serve(w, r, origin.fetch)
+	if origin.last.Header.Get("If-None-Match") != `"v0"` || w.Code != 304 {
+		t.Errorf("browser condition: %q %d", origin.last.Header.Get("If-None-Match"), w.Code)
+	}
+
+	// 内容变了，替换缓存
+	origin.status = 200
+	origin.header.Set("Etag", `"v2"`)
+	origin.body = []byte("version 2")
+	if w = cacheGet(c, url, origin.fetch); w.Body.String() != "version 2" {
+		t.Errorf("changed: %q", w.Body.String())
+	}
+	origin.status = 304
+	origin.body = nil
+	if w = cacheGet(c, url, origin.fetch); w.Body.String() != "version 2" || origin.last.Header.Get("If-None-Match") != `"v2"` {
+		t.Errorf("after change: %q", w.Body.String())
+	}
+	if c.lru.Len() != 1 {
+		t.Errorf("%d entries, want 1", c.lru.Len())
+	}
+
+	// 没有完整收到的应答不缓存
+	const partial = "http://www.example.com/partial"
+	cacheGet(c, partial, func(w http.ResponseWriter, r *http.Request) bool {
+		w.Header().Set("Cache-Control", "max-age=600")
+		w.Header().Set("Content-Length", "10")
+		w.Write([]byte("short"))
+		return false
+	})
+	if _, ok := c.items[diskCacheKey(partial)]; ok {
+		t.Error("incomplete response cached")
+	}
+}
+
+func TestCachePurge(t *testing.T) {
+	defer func(c *diskCache) { httpCache = c }(httpCache)
+	c, cleanup := tempDiskCache(t, 1024*1024)
+	defer cleanup()
+	httpCache = c
+	origin := &fakeOrigin{status: 200, header: http.Header{"Cache-Control": {"max-age=600"}}, body: []byte("body")}
+	cacheGet(c, "http://www.example.com/a", origin.fetch)
+	cacheGet(c, "http://www.example.com/b", origin.fetch)
+
+	h := &handler{ch: make(chan *httpsReq, 1)}
+	tests := []struct {
+		name    string
+		handler http.Handler
+		method  string
+		url     string
+		header  bool
+		status  int
+		left    int
+	}{
+		{"get", listenHandler{h}, "GET", "/_~_/cache/purge", true, 405, 2},
+		{"no header", listenHandler{h}, "POST", "/_~_/cache/purge", false, 403, 2},
+		{"tunnel", h, "POST", "/_~_/cache/purge", true, 404, 2},
+		{"url", listenHandler{h}, "POST", "/_~_/cache/purge?url=http://www.example.com/a", true, 200, 1},
+		{"all", listenHandler{h}, "POST", "/_~_/cache/purge", true, 200, 0},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.url, nil)
+		if tt.header {
+			r.Header.Set(purgeHeader, "1")
+		}
+		w := httptest.NewRecorder()
+		tt.handler.ServeHTTP(w, r)
+		if w.Code != tt.status || c.lru.Len() != tt.left {
+			t.Errorf("%s: %d, %d left, want %d, %d left", tt.name, w.Code, c.lru.Len(), tt.status, tt.left)
+		}
+	}
+}
+
+// 改名失败时保留旧的缓存项和大小
+func TestDiskCacheCommitFailed(t *testing.T) {
+	c, cleanup := tempDiskCache(t, 16*1024)
+	defer cleanup()
+	origin := &fakeOrigin{status: 200, header: http.Header{"Cache-Control": {"max-age=600"}}, body: []byte("hello")}
+	url := "http://www.example.com/commit"
+	cacheGet(c, url, origin.fetch)
+	key := diskCacheKey(url)
+	size := c.size
+	if _, ok := c.items[key]; !ok || size == 0 {
+		t.Fatal("entry not cached")
+	}
+	c.commit(key, c.path(key)+".missing", 100)
+	if _, ok := c.items[key]; !ok || c.size != size {
+		t.Errorf("after failed commit: cached %v, size %d, want %d", ok, c.size, size)
+	}
+	if _, err := os.Stat(c.path(key)); err != nil {
+		t.Errorf("cache file removed: %v", err)
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var (
+	// 分块之间的总长度、ETag或者Last-Modified不一致，目标网站的内容已经变了
+	ErrRangeChanged = errors.New("resource changed between ranges")
+)
+
+/*
+自动分块或者浏览器请求了Range时，第一个分块之后的部分用多个连接并发获取
+每个分块使用不同的IP和appid，完成后放到缓冲里面，按顺序写给浏览器
+同时获取和缓冲的分块不超过range_parallel个，内存最多占用range_parallel*range_size
+分块中途失败时从断开的位置换IP和appid重新获取，内容变化时不再拼接
+*/
+type rangeDownload struct {
+	data  *HttpData
+	body  []byte
+	size  int
+	total int
+	// 第一个分块的ETag和Last-Modified，后面的分块要一致
+	etag         string
+	lastModified string
+	// 下载结束或者浏览器关闭时关闭，通知所有分块停止
+	done chan bool
+}
+
+// header为第一个分块的应答头部
+func newRangeDownload(data *HttpData, body []byte, size int, total int, header http.Header) *rangeDownload {
+	return &rangeDownload{
+		data:         data,
+		body:         body,
+		size:         size,
+		total:        total,
+		etag:         header.Get("ETag"),
+		lastModified: header.Get("Last-Modified"),
+	}
+}
+
+type rangeChunk struct {
+	index int
+	data  []byte
+	err   error
+}
+
+// Content-Range: bytes start-end/total
+func parseContentRange(s string) (start int, end int, total int, ok bool) {
+	if !strings.HasPrefix(s, "bytes ") {
+		return
+	}
+	part := strings.Split(s[len("bytes "):], "/")
+	if len(part) != 2 {
+		return
+	}
+	r := strings.Split(part[0], "-")
+	if len(r) != 2 {
+		return
+	}
+	var err error
+	if start, err = strconv.Atoi(r[0]); err != nil {
+		return
+	}
+	if end, err = strconv.Atoi(r[1]); err != nil {
+		return
+	}
+	if total, err = strconv.Atoi(part[1]); err != nil {
+		return
+	}
+	ok = start <= end && end < total
+	return
+}
+
+// 浏览器请求的Range，只处理单个范围
+// bytes=start-end，end为-1时到结尾；bytes=-suffix为最后suffix个字节
+type byteRange struct {
+	start  int
+	end    int
+	suffix int
+}
+
+func parseRangeHeader(s string) (r byteRange, ok bool) {
+	if !strings.HasPrefix(s, "bytes=") || strings.Contains(s, ",") {
+		return
+	}
+	part := strings.SplitN(strings.TrimSpace(s[len("bytes="):]), "-", 2)
+	if len(part) != 2 {
+		return
+	}
+	var err error
+	if part[0] == "" {
+		r.suffix, err = strconv.Atoi(part[1])
+		return r, err == nil && r.suffix > 0
+	}
+	if r.start, err = strconv.Atoi(part[0]); err != nil || r.start < 0 {
+		return r, false
+	}
+	r.end = -1
+	if part[1] != "" {
+		if r.end, err = strconv.Atoi(part[1]); err != nil || r.end < r.start {
+			return r, false
+		}
+	}
+	return r, true
+}
+
+// 第一次请求的Range，不超过size
+// 后缀超过size时还不知道从哪里开始，先取最后一个字节得到总长度
+func (r byteRange) first(size int) string {
+	if r.suffix > 0 {
+		if r.suffix > size {
+			return "bytes=-1"
+		}
+		return fmt.Sprintf("bytes=-%d", r.suffix)
+	}
+	end := r.start + size - 1
+	if r.end >= 0 && r.end < end {
+		end = r.end
+	}
+	return fmt.Sprintf("bytes=%d-%d", r.start, end)
+}
+
+// 知道总长度之后实际的范围，end超过总长度时到结尾
+func (r byteRange) resolve(total int) (start int, end int) {
+	if r.suffix > 0 {
+		start = total - r.suffix
+		if start < 0 {
+			start = 0
+		}
+		return start, total - 1
+	}
+	end = r.end
+	if end < 0 || end >= total {
+		end = total - 1
+	}
+	return r.start, end
+}
+
+// 从pos开始按顺序写到last，全部写完时返回true
+func (d *rangeDownload) run(w io.Writer, pos int, last int, cn <-chan bool) bool {
+	parallel := config.GoWalk.RangeParallel
+	if parallel < 1 {
+		parallel = 1
+	}
+	count := (last - pos + d.size) / d.size
+	// 同时进行的分块不超过parallel个，发送不会阻塞
+	results := make(chan rangeChunk, parallel)
+	pending := make(map[int][]byte)
+	d.done = make(chan bool)
+	defer close(d.done)
+
+	next, started := 0, 0
+	for next < count {
+		for ; started < count && started < next+parallel; started++ {
+			start := pos + started*d.size
+			end := start + d.size - 1
+			if end > last {
+				end = last
+			}
+			go func(index, start, end int) {
+				data, err := d.fetch(start, end, index)
+				results <- rangeChunk{index, data, err}
+			}(started, start, end)
+		}
+		select {
+		case c := <-results:
+			if c.err != nil {
+				if c.err != ErrClosed {
+					log.Println("Range fetch failed:", d.data.Url, c.err)
+				}
+				return false
+			}
+			pending[c.index] = c.data
+		case <-cn:
+			return false
+		}
+		for data, ok := pending[next]; ok; data, ok = pending[next] {
+			delete(pending, next)
+			if _, err := w.Write(data); err != nil {
+				log.Println("Write data failed:", err)
+				return false
+			}
+			next++
+		}
+	}
+	return true
+}
+
+// 获取[start, end]，服务器端返回的比请求的少时继续获取剩下的部分
+// 失败时保留已经读到的数据，换一个IP和appid从断开的位置继续
+func (d *rangeDownload) fetch(start int, end int, lane int) ([]byte, error) {
+	buf := make([]byte, 0, end-start+1)
+	size := d.size
+	retries := 0
+	for start+len(buf) <= end {
+		pos := start + len(buf)
+		stop := pos + size - 1
+		if stop > end {
+			stop = end
+		}
+		req := d.chunkRequest(pos, stop)
+		if err := signRequest(req, d.body); err != nil {
+			return nil, err
+		}
+		select {
+		case <-tokenCh:
+		case <-d.done:
+			return nil, ErrClosed
+		}
+		resp, err := fetchGAE(req, lane, d.done)
+		if err == nil {
+			buf, err = d.readRange(resp, pos, stop, buf)
+		}
+		tokenCh <- 1
+		if err == nil {
+			retries = 0
+			continue
+		}
+		if start+len(buf) > pos {
+			// 读到了一部分，重新计算重试次数
+			retries = 0
+		}
+		if retries >= maxFetchRetry || !retryRange(err, &size) {
+			return nil, err
+		}
+		retries++
+		// 换一个IP，appid每次请求都会换
+		lane++
+		log.Println("Retry range:", d.data.Url, start+len(buf), err)
+	}
+	return buf, nil
+}
+
+// 复制第一次的请求，只请求[pos, stop]
+// 每个分块只要请求的范围，服务器端不能去掉Range重新获取，也不再分段并发
+func (d *rangeDownload) chunkRequest(pos int, stop int) *HttpData {
+	req := *d.data
+	req.AutoRange = false
+	req.Parallel = 0
+	req.Header = make(http.Header, len(d.data.Header))
+	for k, v := range d.data.Header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", pos, stop))
+	return &req
+}
+
+// 分块失败时是否可以重试，应答过大时减小分块
+func retryRange(err error, size *int) bool {
+	switch e := err.(type) {
+	case *FetchError:
+		switch e.Code {
+		case ErrorDeadline, ErrorFetch:
+			return true
+		case ErrorOverQuota:
+			markOverQuota(e.AppId)
+			return true
+		case ErrorTooLarge:
+			if *size > minRangeSize {
+				*size /= 2
+				return true
+			}
+		}
+		return false
+	case *ServerError:
+		return e.Status != http.StatusForbidden
+	case *MismatchError:
+		return false
+	}
+	return err != ErrClosed && err != ErrAllIpBad && err != ErrRangeChanged
+}
+
+// 读取一个分块的应答，追加到buf后面，出错时返回已经读到的部分
+func (d *rangeDownload) readRange(resp *HttpData, pos int, stop int, buf []byte) ([]byte, error) {
+	defer resp.Body.Close()
+	if resp.Status != 206 {
+		// 目标网站不再支持Range，或者内容变了
+		return buf, ErrRangeChanged
+	}
+	v := resp.Header.Get("Content-Range")
+	start, end, total, ok := parseContentRange(v)
+	if !ok || start != pos || end > stop {
+		return buf, fmt.Errorf("unexpected range %q, request %d-%d", v, pos, stop)
+	}
+	if total != d.total {
+		return buf, ErrRangeChanged
+	}
+	if d.etag != "" && resp.Header.Get("ETag") != d.etag {
+		return buf, ErrRangeChanged
+	}
+	if d.lastModified != "" && resp.Header.Get("Last-Modified") != d.lastModified {
+		return buf, ErrRangeChanged
+	}
+	n := len(buf)
+	m, err := io.ReadFull(resp.Body, buf[n:n+end-start+1])
+	return buf[:n+m], err
+}
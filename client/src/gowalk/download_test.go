@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestParseContentRange(t *testing.T) {
+	for _, tt := range []struct {
+		s                 string
+		start, end, total int
+		ok                bool
+	}{
+		{"bytes 0-99/1000", 0, 99, 1000, true},
+		{"bytes 900-999/1000", 900, 999, 1000, true},
+		{"bytes 0-0/1", 0, 0, 1, true},
+		{"bytes 100-99/1000", 0, 0, 0, false},
+		{"bytes 0-1000/1000", 0, 0, 0, false},
+		{"bytes 0-99/*", 0, 0, 0, false},
+		{"bytes */1000", 0, 0, 0, false},
+		{"bytes 0-99", 0, 0, 0, false},
+		{"items 0-99/1000", 0, 0, 0, false},
+		{"bytes a-99/1000", 0, 0, 0, false},
+		{"", 0, 0, 0, false},
+	} {
+		start, end, total, ok := parseContentRange(tt.s)
+		if ok != tt.ok || ok && (start != tt.start || end != tt.end || total != tt.total) {
+			t.Errorf("%q: %d %d %d %v", tt.s, start, end, total, ok)
+		}
+	}
+}
+
+func TestRetryRange(t *testing.T) {
+	for _, tt := range []struct {
+		err   error
+		size  int
+		retry bool
+		want  int
+	}{
+		{&FetchError{Code: ErrorDeadline}, minRangeSize, true, minRangeSize},
+		{&FetchError{Code: ErrorFetch}, minRangeSize, true, minRangeSize},
+		{&FetchError{Code: ErrorTooLarge}, 4 * minRangeSize, true, 2 * minRangeSize},
+		{&FetchError{Code: ErrorTooLarge}, minRangeSize, false, minRangeSize},
+		{&FetchError{Code: ErrorDenied}, minRangeSize, false, minRangeSize},
+		{&ServerError{Status: http.StatusInternalServerError}, minRangeSize, true, minRangeSize},
+		{&ServerError{Status: http.StatusForbidden}, minRangeSize, false, minRangeSize},
+		{&MismatchError{}, minRangeSize, false, minRangeSize},
+		{ErrRangeChanged, minRangeSize, false, minRangeSize},
+		{ErrClosed, minRangeSize, false, minRangeSize},
+		{ErrAllIpBad, minRangeSize, false, minRangeSize},
+		{errors.New("unexpected EOF"), minRangeSize, true, minRangeSize},
+	} {
+		size := tt.size
+		if retry := retryRange(tt.err, &size); retry != tt.retry || size != tt.want {
+			t.Errorf("%v: %v %d, want %v %d", tt.err, retry, size, tt.retry, tt.want)
+		}
+	}
+}
+
+func TestChunkRequest(t *testing.T) {
+	data := &HttpData{
+		Method:    "GET",
+		Url:       "http://www.example.com/big",
+		Header:    http.Header{"Range": {"bytes=0-1023"}, "Accept": {"*/*"}},
+		AutoRange: true,
+		Parallel:  4,
+	}
+	d := newRangeDownload(data, nil, 1024, 10000, make(http.Header))
+	req := d.chunkRequest(1024, 2047)
+	if req.AutoRange || req.Parallel != 0 {
+		t.Errorf("chunk AutoRange %v Parallel %d", req.AutoRange, req.Parallel)
+	}
+	if req.Header.Get("Range") != "bytes=1024-2047" || req.Header.Get("Accept") != "*/*" {
+		t.Errorf("chunk header %v", req.Header)
+	}
+	// 不能改到第一次的请求
+	if !data.AutoRange || data.Parallel != 4 || data.Header.Get("Range") != "bytes=0-1023" {
+		t.Errorf("original request changed: %+v", data)
+	}
+}
+
+func TestParseRangeHeader(t *testing.T) {
+	for _, tt := range []struct {
+		s  string
+		r  byteRange
+		ok bool
+	}{
+		{"bytes=0-99", byteRange{0, 99, 0}, true},
+		{"bytes=100-", byteRange{100, -1, 0}, true},
+		{"bytes= 5-5", byteRange{5, 5, 0}, true},
+		{"bytes=-500", byteRange{0, 0, 500}, true},
+		{"bytes=-0", byteRange{}, false},
+		{"bytes=99-0", byteRange{}, false},
+		{"bytes=-5-9", byteRange{}, false},
+		{"bytes=0-99,200-299", byteRange{}, false},
+		{"bytes=a-", byteRange{}, false},
+		{"bytes=", byteRange{}, false},
+		{"items=0-99", byteRange{}, false},
+	} {
+		r, ok := parseRangeHeader(tt.s)
+		if ok != tt.ok || ok && r != tt.r {
+			t.Errorf("%q: %+v %v, want %+v %v", tt.s, r, ok, tt.r, tt.ok)
+		}
+	}
+}
+
+func TestByteRange(t *testing.T) {
+	const size = 1000
+	for _, tt := range []struct {
+		r          byteRange
+		first      string
+		total      int
+		start, end int
+	}{
+		{byteRange{0, -1, 0}, "bytes=0-999", 5000, 0, 4999},
+		{byteRange{100, 199, 0}, "bytes=100-199", 5000, 100, 199},
+		{byteRange{100, 4000, 0}, "bytes=100-1099", 5000, 100, 4000},
+		{byteRange{100, 9000, 0}, "bytes=100-1099", 5000, 100, 4999},
+		{byteRange{0, 0, 500}, "bytes=-500", 5000, 4500, 4999},
+		{byteRange{0, 0, 500}, "bytes=-500", 300, 0, 299},
+		{byteRange{0, 0, 3000}, "bytes=-1", 5000, 2000, 4999},
+	} {
+		if first := tt.r.first(size); first != tt.first {
+			t.Errorf("%+v first: %s, want %s", tt.r, first, tt.first)
+		}
+		if start, end := tt.r.resolve(tt.total); start != tt.start || end != tt.end {
+			t.Errorf("%+v resolve(%d): %d-%d, want %d-%d", tt.r, tt.total, start, end, tt.start, tt.end)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	// 浏览器已经关闭了连接
+	ErrClosed = errors.New("closed")
+)
+
+// GAE代理程序没有返回帧，而是返回了错误的HTTP应答
+type ServerError struct {
+	AppId  string
+	Status int
+	Msg    string
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("appid %s: status %d: %s", e.AppId, e.Status, e.Msg)
+}
+
+// 服务器端获取失败，返回了带错误类型的应答帧
+type FetchError struct {
+	AppId string
+	Code  ErrorCode
+	Msg   string
+}
+
+func (e *FetchError) Error() string {
+	return fmt.Sprintf("appid %s: %v: %s", e.AppId, e.Code, e.Msg)
+}
+
+// 应答帧带有错误类型时，关闭body并返回FetchError
+func frameError(appid string, data *HttpData) error {
+	if data.Error == ErrorNone {
+		return nil
+	}
+	data.Body.Close()
+	return &FetchError{appid, data.Error, data.ErrorMsg}
+}
+
+const (
+	// 配额用完的appid多久之后再尝试
+	overQuotaDelay = time.Hour
+)
+
+var (
+	quotaLock sync.Mutex
+	// 配额用完的appid，到期之前不再使用
+	overQuota = make(map[string]time.Time)
+)
+
+func markOverQuota(appid string) {
+	log.Println("AppId over quota:", appid)
+	quotaLock.Lock()
+	overQuota[appid] = time.Now().Add(overQuotaDelay)
+	quotaLock.Unlock()
+}
+
+// 轮流使用appid，跳过配额用完的appid，全部用完时仍然轮流使用
+func nextAppId() string {
+	quotaLock.Lock()
+	defer quotaLock.Unlock()
+	now := time.Now()
+	for i := 0; i < len(config.GoWalk.AppId); i++ {
+		appid := config.GoWalk.AppId[appIndex]
+		appIndex = (appIndex + 1) % len(config.GoWalk.AppId)
+		if t, ok := overQuota[appid]; !ok || now.After(t) {
+			delete(overQuota, appid)
+			return appid
+		}
+	}
+	appid := config.GoWalk.AppId[appIndex]
+	appIndex = (appIndex + 1) % len(config.GoWalk.AppId)
+	return appid
+}
+
+// 帧的body读完后同时关闭GAE的应答
+type respBody struct {
+	io.ReadCloser
+	resp *http.Response
+}
+
+func (b *respBody) Close() error {
+	b.ReadCloser.Close()
+	return b.resp.Body.Close()
+}
+
+// 将编码好的内容POST到GAE，网络错误时换IP重试，lane参考getLaneIp
+func postGAE(body []byte, lane int, cn <-chan bool) (resp *http.Response, appid string, err error) {
+	for {
+		select {
+		case <-cn:
+			// 如果客户端已经关闭连接，那我们也不做了，节省点资源
+			return nil, "", ErrClosed
+		default:
+		}
+		var ip = getLaneIp(lane)
+		if ip == "" {
+			return nil, "", ErrAllIpBad
+		}
+
+		appid = nextAppId()
+		var req *http.Request
+		req, err = http.NewRequest("POST", "https://"+ip, bytes.NewReader(body))
+		if err != nil {
+			return nil, "", err
+		}
+		req.Host = appid + ".appspot.com"
+		req.Header.Set("Connection", "keep-alive")
+
+		resp, err = client.Transport.RoundTrip(req)
+		if err != nil {
+			suspCh <- ip
+			log.Println("Fetch failed:", err)
+			continue
+		}
+		if resp.StatusCode != 200 {
+			// GAE代理程序出错
+			defer resp.Body.Close()
+			msg, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				suspCh <- ip
+				return nil, appid, err
+			}
+			if v := resp.Header.Get("X-GW-Protocol"); v != "" {
+				return nil, appid, &MismatchError{appid, fmt.Sprintf("server protocol version %s, client protocol version %d", v, protocolVersion)}
+			}
+			return nil, appid, &ServerError{appid, resp.StatusCode, string(msg)}
+		}
+		return resp, appid, nil
+	}
+}
+
+// 通过GAE获取一个请求，返回的body读完后需要Close
+func fetchGAE(data *HttpData, lane int, cn <-chan bool) (*HttpData, error) {
+	var buff = new(bytes.Buffer)
+	var err = encode(data, buff, cn)
+	if err != nil {
+		return nil, err
+	}
+	resp, appid, err := postGAE(buff.Bytes(), lane, cn)
+	if err != nil {
+		return nil, err
+	}
+	data2, err := decode(resp.Body)
+	if _, ok := err.(*VersionError); ok {
+		resp.Body.Close()
+		return nil, &MismatchError{appid, err.Error()}
+	}
+	if err != nil {
+		resp.Body.Close()
+		log.Println("Decode content failed:", appid, err)
+		return nil, err
+	}
+	data2.Body = &respBody{data2.Body, resp}
+	if err = frameError(appid, data2); err != nil {
+		return nil, err
+	}
+	return data2, nil
+}
+
+// 将fetchGAE的错误返回给浏览器
+func fetchError(w http.ResponseWriter, err error) {
+	switch e := err.(type) {
+	case *FetchError:
+		log.Println("Fetch failed:", err)
+		status := http.StatusBadGateway
+		switch e.Code {
+		case ErrorDeadline:
+			status = http.StatusGatewayTimeout
+		case ErrorOverQuota:
+			status = http.StatusServiceUnavailable
+		case ErrorInvalidUrl:
+			status = http.StatusBadRequest
+		case ErrorUnauthorized, ErrorForbidden, ErrorDenied:
+			status = http.StatusForbidden
+		case ErrorQuotaExceeded:
+			status = 429
+		}
+		errorPage(w, status, e.Code.String(), e.Error())
+	case *ServerError:
+		if e.Status == http.StatusForbidden {
+			errorPage(w, e.Status, "unauthorized", "Please check the password and encrypt in gowalk.conf: "+e.Error())
+			return
+		}
+		http.Error(w, e.Msg, e.Status)
+	case *MismatchError:
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	default:
+		if err == ErrClosed {
+			return
+		}
+		if err == ErrAllIpBad {
+			log.Println("All IP bad")
+			http.Error(w, "All IP bad", http.StatusBadGateway)
+			return
+		}
+		log.Println("Fetch content failed:", err)
+		http.Error(w, "InternalServerError", http.StatusInternalServerError)
+	}
+}
+
+var errorTemplate = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>gowalk: {{.Title}}</title></head>
+<body>
+<h1>{{.Status}} {{.Title}}</h1>
+<p>{{.Msg}}</p>
+</body>
+</html>
+`))
+
+// 返回给浏览器的错误页面
+func errorPage(w http.ResponseWriter, status int, title string, msg string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	errorTemplate.Execute(w, struct {
+		Status int
+		Title  string
+		Msg    string
+	}{status, title, msg})
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHttp2HopHeaders(t *testing.T) {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+	tr := ts.Client().Transport
+
+	req, _ := http.NewRequest("GET", ts.URL, nil)
+	req.Header.Set("Upgrade", "websocket")
+	if _, err := tr.RoundTrip(req); err == nil {
+		t.Fatal("upgrade over h2 accepted")
+	}
+	// 去掉逐跳头部之后可以通过h2发送
+	req.Header = cloneHeader(req.Header)
+	removeHopHeaders(req.Header)
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Errorf("proto %s", resp.Proto)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestRemoveHopHeaders(t *testing.T) {
+	h := http.Header{
+		"Connection":          {"keep-alive, X-Custom", "Upgrade"},
+		"Proxy-Connection":    {"keep-alive"},
+		"Proxy-Authorization": {"Basic eA=="},
+		"Upgrade":             {"websocket"},
+		"Te":                  {"trailers"},
+		"X-Custom":            {"1"},
+		"Accept":              {"*/*"},
+		"Cookie":              {"a=b"},
+	}
+	removeHopHeaders(h)
+	want := http.Header{"Accept": {"*/*"}, "Cookie": {"a=b"}}
+	if !reflect.DeepEqual(h, want) {
+		t.Errorf("got %v, want %v", h, want)
+	}
+}
+
+func TestFilterAcceptEncoding(t *testing.T) {
+	for _, tt := range []struct {
+		in, want string
+	}{
+		{"", ""},
+		{"gzip, deflate, br", "gzip, deflate"},
+		{"br", ""},
+		{"GZIP;q=1.0, br;q=0.9, identity", "GZIP;q=1.0, identity"},
+		{"sdch,gzip", "gzip"},
+	} {
+		h := make(http.Header)
+		if tt.in != "" {
+			h.Set("Accept-Encoding", tt.in)
+		}
+		filterAcceptEncoding(h)
+		if got := h.Get("Accept-Encoding"); got != tt.want {
+			t.Errorf("%q: %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSanitizeRequest(t *testing.T) {
+	rules := []PrivacyRule{
+		{Headers: []string{"X-Forwarded-For"}},
+		{Domains: []string{".example.com"}, Headers: []string{"Referer"}},
+	}
+	for _, tt := range []struct {
+		host    string
+		referer bool
+	}{
+		{"www.example.com", false},
+		{"example.com:443", false},
+		{"www.example.org", true},
+	} {
+		h := http.Header{
+			"X-Forwarded-For": {"10.0.0.1"},
+			"Referer":         {"https://a/"},
+			"Content-Length":  {"3"},
+			"Connection":      {"close"},
+		}
+		sanitizeRequest(h, tt.host, rules)
+		if h.Get("X-Forwarded-For") != "" || h.Get("Content-Length") != "" || h.Get("Connection") != "" {
+			t.Errorf("%s: %v", tt.host, h)
+		}
+		if (h.Get("Referer") != "") != tt.referer {
+			t.Errorf("%s: Referer %q", tt.host, h.Get("Referer"))
+		}
+	}
+}
@@ -0,0 +1,15 @@
+//go:build go1.13
+// +build go1.13
+
+package main
+
+import (
+	"net/http"
+)
+
+// go1.13以上的http.Transport在自定义了TLS配置时也可以通过ALPN协商h2
+// 服务器端不支持h2时自动使用HTTP/1.1
+func enableHttp2(t *http.Transport) bool {
+	t.ForceAttemptHTTP2 = true
+	return true
+}
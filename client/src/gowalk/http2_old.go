@@ -0,0 +1,13 @@
+//go:build !go1.13
+// +build !go1.13
+
+package main
+
+import (
+	"net/http"
+)
+
+// 旧版本的http.Transport不能在自定义TLS配置时使用h2
+func enableHttp2(t *http.Transport) bool {
+	return false
+}
@@ -286,10 +286,15 @@ func IpInit() {
 	// 并发为了提高性能，但是会影响后续使用
 	// 所以找到后就关闭这100个并发
 	// 然后留5个慢慢搜索
-	for i := 0; i < 95; i++ {
+	fast, slow := 95, 5
+	if len(config.GoWalk.Upstream) > 0 {
+		// 通过上级代理扫描时每个IP都要和代理握手，只用少量并发，避免压垮上级代理
+		fast, slow = upstreamScanWorkers-1, 1
+	}
+	for i := 0; i < fast; i++ {
 		go checkworker(4)
 	}
-	for i := 0; i < 5; i++ {
+	for i := 0; i < slow; i++ {
 		go checkworker(20)
 	}
 
@@ -297,6 +302,18 @@ func IpInit() {
 	log.Println("IP搜索完成，开始工作")
 }
 
+// 通过上级代理扫描IP时的并发数
+const upstreamScanWorkers = 4
+
+// 扫描时先建立TCP连接，去掉不通的IP
+// 通过上级代理时连接包括代理的握手，不能用很短的超时
+func scanDial(addr string) (net.Conn, error) {
+	if len(config.GoWalk.Upstream) > 0 {
+		return upstreamDial("tcp", addr)
+	}
+	return net.DialTimeout("tcp", addr, time.Millisecond*100)
+}
+
 func checkworker(max int32) {
 	for {
 		if atomic.LoadInt32(&iptotal) >= max {
@@ -304,7 +321,7 @@ func checkworker(max int32) {
 		}
 		var ip = randomIp()
 
-		c, err := net.DialTimeout("tcp", ip+":443", time.Millisecond*100)
+		c, err := scanDial(ip + ":443")
 		if err != nil {
 			continue
 		}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminPages(t *testing.T) {
+	h := &handler{ch: make(chan *httpsReq, 1)}
+	tests := []struct {
+		name    string
+		handler http.Handler
+		url     string
+		status  int
+	}{
+		{"listen status", listenHandler{h}, "/_~_/status", 200},
+		// MITM隧道里面的请求和直接请求一样只有路径
+		{"tunnel status", h, "/_~_/status", 404},
+		{"tunnel pac", h, "/_~_/gowalk.pac", 404},
+		{"listen rule", listenHandler{h}, "/_~_/rule?url=https://www.google.com/", 200},
+		{"tunnel rule", h, "/_~_/rule?url=https://www.google.com/", 404},
+		{"tunnel other", h, "/_~_/x", 404},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", tt.url, nil)
+		r.URL.Host = ""
+		w := httptest.NewRecorder()
+		tt.handler.ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s: %d, want %d", tt.name, w.Code, tt.status)
+		}
+	}
+}
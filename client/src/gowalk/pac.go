@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// 规则在PAC里面的形式，只有direct在浏览器里面直接连接，其他的都交给gowalk按规则处理
+type pacRule struct {
+	Domains []string    `json:"domains,omitempty"`
+	Hosts   []string    `json:"hosts,omitempty"`
+	Regexps []string    `json:"regexps,omitempty"`
+	Regexp  string      `json:"regexp,omitempty"`
+	Nets    [][2]string `json:"nets,omitempty"`
+	Ports   []int       `json:"ports,omitempty"`
+	// 有IPv6地址段，浏览器里面不能判断，IPv6地址都交给gowalk
+	Nets6 bool `json:"nets6,omitempty"`
+	// 有https解密之后才能判断的paths，其他条件匹配时交给gowalk
+	Uncertain bool `json:"uncertain,omitempty"`
+	Direct    bool `json:"direct"`
+}
+
+// AutoProxy列表，"||"开头的域名放在Domains里面，其他的转换成匹配URL的正则表达式
+type pacList struct {
+	Domains map[string]int `json:"domains"`
+	Regexps []string       `json:"regexps"`
+}
+
+var (
+	// 生成的PAC里面除了代理地址以外的部分
+	pacScript []byte
+	pacTime   time.Time
+)
+
+// 通配符转换为正则表达式，Go和javascript的语法在这里是一样的
+func wildcardRegexp(pattern string) string {
+	return strings.Replace(regexp.QuoteMeta(pattern), `\*`, ".*", -1)
+}
+
+func pacRules() []pacRule {
+	list := make([]pacRule, 0, len(rules))
+	for _, r := range rules {
+		p := pacRule{Ports: r.Ports, Regexp: r.Regexp, Direct: r.action == actionDirect}
+		for _, h := range r.Hosts {
+			h = strings.ToLower(h)
+			switch {
+			case strings.HasPrefix(h, "."):
+				p.Domains = append(p.Domains, h[1:])
+			case strings.Contains(h, "*"):
+				p.Regexps = append(p.Regexps, "^"+wildcardRegexp(h)+"$")
+			default:
+				p.Hosts = append(p.Hosts, h)
+			}
+		}
+		for _, n := range r.nets {
+			if n.IP.To4() == nil {
+				p.Nets6 = true
+				continue
+			}
+			p.Nets = append(p.Nets, [2]string{n.IP.String(), net.IP(n.Mask).String()})
+		}
+		if len(r.Paths) > 0 {
+			p.Uncertain = true
+		}
+		list = append(list, p)
+	}
+	return list
+}
+
+// AutoProxy的列表可能是base64编码的，比如gfwlist.txt
+func decodeAutoProxy(data []byte) []byte {
+	text := bytes.TrimSpace(data)
+	if bytes.HasPrefix(text, []byte("[")) || bytes.HasPrefix(text, []byte("!")) {
+		return text
+	}
+	decoded, err := base64.StdEncoding.DecodeString(string(bytes.Join(bytes.Fields(text), nil)))
+	if err != nil {
+		return text
+	}
+	return decoded
+}
+
+/*
+AutoProxy的规则，参考 https://autoproxy.org/zh-CN/Rules
+! 开头为注释，[ 开头为文件头
+@@ 开头为例外，匹配时直接连接
+|| 开头匹配域名和所有子域名
+| 开头匹配URL的开头，| 结尾匹配URL的结尾
+/ 开头和结尾为正则表达式
+其他为URL里面的关键字，* 为通配符
+*/
+func parseAutoProxy(data []byte) (proxy *pacList, direct *pacList) {
+	proxy = &pacList{Domains: make(map[string]int), Regexps: []string{}}
+	direct = &pacList{Domains: make(map[string]int), Regexps: []string{}}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '!' || line[0] == '[' {
+			continue
+		}
+		list := proxy
+		if strings.HasPrefix(line, "@@") {
+			list = direct
+			line = line[2:]
+		}
+		switch {
+		case strings.HasPrefix(line, "||"):
+			domain := line[2:]
+			if strings.ContainsAny(domain, "/*") {
+				list.Regexps = append(list.Regexps, `^[\w\-]+:\/+(?:[^\/]+\.)?`+wildcardRegexp(domain))
+			} else {
+				list.Domains[strings.ToLower(domain)] = 1
+			}
+		case len(line) > 2 && line[0] == '/' && line[len(line)-1] == '/':
+			list.Regexps = append(list.Regexps, line[1:len(line)-1])
+		default:
+			re := ""
+			if strings.HasPrefix(line, "|") {
+				re = "^"
+				line = line[1:]
+			}
+			end := ""
+			if strings.HasSuffix(line, "|") {
+				end = "$"
+				line = line[:len(line)-1]
+			}
+			if line != "" {
+				list.Regexps = append(list.Regexps, re+wildcardRegexp(line)+end)
+			}
+		}
+	}
+	return
+}
+
+// 浏览器里面执行的部分，proxy由pacHandler在前面定义
+const pacFunctions = `
+function matchDomains(host, domains) {
+    var pos = 0;
+    while (true) {
+        if (domains.hasOwnProperty(host.slice(pos))) {
+            return true;
+        }
+        pos = host.indexOf('.', pos) + 1;
+        if (pos <= 0) {
+            return false;
+        }
+    }
+}
+
+// 正则表达式只在加载时编译一次，javascript不支持的返回null
+function compileRegexp(s) {
+    try {
+        return new RegExp(s);
+    } catch (e) {
+        return null;
+    }
+}
+
+function compileRegexps(list) {
+    var out = [];
+    for (var i = 0; i < list.length; i++) {
+        var re = compileRegexp(list[i]);
+        if (re) {
+            out.push(re);
+        }
+    }
+    return out;
+}
+
+function matchRegexps(s, list) {
+    for (var i = 0; i < list.length; i++) {
+        if (list[i].test(s)) {
+            return true;
+        }
+    }
+    return false;
+}
+
+(function() {
+    for (var i = 0; i < rules.length; i++) {
+        var r = rules[i];
+        if (r.regexps) {
+            r.regexps = compileRegexps(r.regexps);
+        }
+        if (r.regexp) {
+            r.regexp = compileRegexp(r.regexp) || 'invalid';
+        }
+    }
+    proxyList.regexps = compileRegexps(proxyList.regexps);
+    directList.regexps = compileRegexps(directList.regexps);
+})();
+
+function urlPort(url) {
+    var m = /^([\w\-]+):\/\/(?:[^\/@]*@)?(\[[^\]]*\]|[^\/:]*)(?::(\d+))?/.exec(url);
+    if (!m) {
+        return 0;
+    }
+    if (m[3]) {
+        return parseInt(m[3], 10);
+    }
+    return m[1].toLowerCase() == 'https' ? 443 : 80;
+}
+
+// 规则按顺序匹配，返回null表示都不匹配
+// 不能确定是否匹配的规则返回proxy，由gowalk判断
+function matchRules(url, host) {
+    var ipv4 = /^\d+\.\d+\.\d+\.\d+$/.test(host);
+    for (var i = 0; i < rules.length; i++) {
+        var r = rules[i], j, ok, unsure = r.uncertain;
+        if (r.domains || r.hosts || r.regexps) {
+            ok = false;
+            for (j = 0; r.domains && j < r.domains.length && !ok; j++) {
+                ok = host == r.domains[j] || dnsDomainIs(host, '.' + r.domains[j]);
+            }
+            for (j = 0; r.hosts && j < r.hosts.length && !ok; j++) {
+                ok = host == r.hosts[j];
+            }
+            ok = ok || (r.regexps && matchRegexps(host, r.regexps));
+            if (!ok) {
+                continue;
+            }
+        }
+        if (r.regexp == 'invalid') {
+            unsure = true;
+        } else if (r.regexp && !r.regexp.test(host)) {
+            continue;
+        }
+        if (r.nets || r.nets6) {
+            ok = false;
+            for (j = 0; ipv4 && r.nets && j < r.nets.length && !ok; j++) {
+                ok = isInNet(host, r.nets[j][0], r.nets[j][1]);
+            }
+            if (!ok && r.nets6 && host.indexOf(':') >= 0) {
+                ok = unsure = true;
+            }
+            if (!ok) {
+                continue;
+            }
+        }
+        if (r.ports && r.ports.indexOf(urlPort(url)) < 0) {
+            continue;
+        }
+        if (unsure) {
+            return proxy;
+        }
+        return r.direct ? 'DIRECT' : proxy;
+    }
+    return null;
+}
+
+function FindProxyForURL(url, host) {
+    host = host.toLowerCase();
+    if (isPlainHostName(host) && host.indexOf(':') < 0) {
+        return 'DIRECT';
+    }
+    var result = matchRules(url, host);
+    if (result) {
+        return result;
+    }
+    if (matchDomains(host, directList.domains) || matchRegexps(url, directList.regexps)) {
+        return 'DIRECT';
+    }
+    if (matchDomains(host, proxyList.domains) || matchRegexps(url, proxyList.regexps)) {
+        return proxy;
+    }
+    return defaultResult;
+}
+`
+
+// 根据规则和AutoProxy列表生成PAC，启动时调用一次
+// 没有AutoProxy列表时，不匹配规则的请求都走gowalk
+func initPac() {
+	proxyList := &pacList{Domains: map[string]int{}, Regexps: []string{}}
+	directList := &pacList{Domains: map[string]int{}, Regexps: []string{}}
+	defaultResult := "proxy"
+	if config.GoWalk.Gfwlist != "" {
+		data, err := ioutil.ReadFile(config.GoWalk.Gfwlist)
+		if err != nil {
+			log.Println("Read gfwlist failed:", err)
+		} else {
+			proxyList, directList = parseAutoProxy(decodeAutoProxy(data))
+			defaultResult = "'DIRECT'"
+			log.Println("Load gfwlist:", config.GoWalk.Gfwlist, len(proxyList.Domains)+len(proxyList.Regexps), "rules")
+		}
+	}
+	var buff bytes.Buffer
+	for _, v := range []struct {
+		name  string
+		value interface{}
+	}{
+		{"rules", pacRules()},
+		{"proxyList", proxyList},
+		{"directList", directList},
+	} {
+		data, err := json.Marshal(v.value)
+		if err != nil {
+			log.Fatalln("Marshal PAC failed:", err)
+		}
+		buff.WriteString("var " + v.name + " = ")
+		buff.Write(data)
+		buff.WriteString(";\n")
+	}
+	buff.WriteString("var defaultResult = " + defaultResult + ";\n")
+	buff.WriteString(pacFunctions)
+	pacScript = buff.Bytes()
+	pacTime = time.Now()
+}
+
+// PAC里面的代理地址，优先使用浏览器访问PAC时的地址，其次是实际监听的地址
+func pacProxyAddr(r *http.Request) string {
+	if r.Host != "" {
+		return r.Host
+	}
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		return addr.String()
+	}
+	return config.GoWalk.Listen
+}
+
+func pacHandler(w http.ResponseWriter, r *http.Request) {
+	var buff bytes.Buffer
+	buff.WriteString("// Proxy Auto-Config file generated by gowalk, " + pacTime.Format("2006-01-02 15:04:05") + "\n")
+	// Host来自请求头部，编码成JSON字符串之后才能放进脚本
+	proxy, _ := json.Marshal("PROXY " + pacProxyAddr(r))
+	buff.WriteString("var proxy = ")
+	buff.Write(proxy)
+	buff.WriteString(";\n")
+	buff.Write(pacScript)
+	sum := sha1.Sum(buff.Bytes())
+	w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	w.Header().Set("Cache-Control", "max-age=600")
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:8])+`"`)
+	// ServeContent处理If-None-Match和If-Modified-Since
+	http.ServeContent(w, r, "gowalk.pac", pacTime, bytes.NewReader(buff.Bytes()))
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestParseAutoProxy(t *testing.T) {
+	list := `[AutoProxy 0.2.9]
+! comment
+||Example.COM
+||example.org/path*
+|http://a.com/
+.b.com
+/^https?:\/\/[^\/]+c\.com/
+keyword*
+end.js|
+@@||direct.example.com
+@@|https://d.com
+
+`
+	proxy, direct := parseAutoProxy([]byte(list))
+	wantProxy := &pacList{
+		Domains: map[string]int{"example.com": 1},
+		Regexps: []string{
+			`^[\w\-]+:\/+(?:[^\/]+\.)?example\.org/path.*`,
+			`^http://a\.com/`,
+			`\.b\.com`,
+			`^https?:\/\/[^\/]+c\.com`,
+			`keyword.*`,
+			`end\.js$`,
+		},
+	}
+	wantDirect := &pacList{
+		Domains: map[string]int{"direct.example.com": 1},
+		Regexps: []string{`^https://d\.com`},
+	}
+	if !reflect.DeepEqual(proxy, wantProxy) {
+		t.Errorf("proxy %+v, want %+v", proxy, wantProxy)
+	}
+	if !reflect.DeepEqual(direct, wantDirect) {
+		t.Errorf("direct %+v, want %+v", direct, wantDirect)
+	}
+	for _, re := range append(proxy.Regexps, direct.Regexps...) {
+		if _, err := regexp.Compile(re); err != nil {
+			t.Errorf("%q: %v", re, err)
+		}
+	}
+	if !regexp.MustCompile(proxy.Regexps[0]).MatchString("https://www.example.org/path/x") {
+		t.Error("domain with path does not match")
+	}
+}
+
+func TestDecodeAutoProxy(t *testing.T) {
+	plain := "[AutoProxy 0.2.9]\n||example.com\n"
+	encoded := base64.StdEncoding.EncodeToString([]byte(plain))
+	// gfwlist按64个字符换行
+	wrapped := encoded[:10] + "\r\n" + encoded[10:] + "\n"
+	for name, in := range map[string]string{
+		"plain":   plain,
+		"comment": "! x\n||example.com",
+		"base64":  encoded,
+		"wrapped": wrapped,
+		"invalid": "||example.com",
+	} {
+		out := string(decodeAutoProxy([]byte(in)))
+		if !strings.Contains(out, "||example.com") {
+			t.Errorf("%s: %q", name, out)
+		}
+	}
+}
+
+func TestPacRules(t *testing.T) {
+	defer func(r []*rule, c []Rule, b []string) {
+		rules, config.GoWalk.Rules, config.GoWalk.ByPass = r, c, b
+	}(rules, config.GoWalk.Rules, config.GoWalk.ByPass)
+	config.GoWalk.ByPass = nil
+	config.GoWalk.Rules = []Rule{
+		{Hosts: []string{".Google.com", "*.example.*", "a.com"}, Ports: []int{443}, Action: "bypass"},
+		{Nets: []string{"10.0.0.0/8", "::1"}, Regexp: "^x", Action: "direct"},
+		{Hosts: []string{"b.com"}, Paths: []string{"/p*"}, Action: "direct"},
+	}
+	if err := initRules(); err != nil {
+		t.Fatal(err)
+	}
+	want := []pacRule{
+		{Domains: []string{"google.com"}, Regexps: []string{`^.*\.example\..*$`}, Hosts: []string{"a.com"}, Ports: []int{443}},
+		{Nets: [][2]string{{"10.0.0.0", "255.0.0.0"}}, Nets6: true, Regexp: "^x", Direct: true},
+		{Hosts: []string{"b.com"}, Uncertain: true, Direct: true},
+	}
+	if got := pacRules(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestPacHandler(t *testing.T) {
+	defer func(r []*rule, g string) { rules, config.GoWalk.Gfwlist = r, g }(rules, config.GoWalk.Gfwlist)
+	rules = nil
+	// 发布的列表能够解析，而且只有域名
+	config.GoWalk.Gfwlist = "../../gfwlist.txt"
+	initPac()
+	if !bytes.Contains(pacScript, []byte(`"wikipedia.org":1`)) || !bytes.Contains(pacScript, []byte("var defaultResult = 'DIRECT';")) {
+		t.Errorf("gfwlist not loaded")
+	}
+	if !bytes.Contains(pacScript, []byte(`"regexps":[]`)) {
+		t.Errorf("gfwlist has non-domain rules")
+	}
+
+	r := httptest.NewRequest("GET", "/_~_/gowalk.pac", nil)
+	r.Host = "192.168.1.2:18087"
+	w := httptest.NewRecorder()
+	pacHandler(w, r)
+	body, _ := ioutil.ReadAll(w.Body)
+	if w.Code != 200 || !bytes.Contains(body, []byte(`var proxy = "PROXY 192.168.1.2:18087";`)) {
+		t.Errorf("pac: %d %.100s", w.Code, body)
+	}
+	// Host里面的引号、反斜杠和换行不能破坏脚本
+	bad := httptest.NewRequest("GET", "/_~_/gowalk.pac", nil)
+	bad.Host = "a'\\\"\n;alert(1)//"
+	w2 := httptest.NewRecorder()
+	pacHandler(w2, bad)
+	body2, _ := ioutil.ReadAll(w2.Body)
+	if !bytes.Contains(body2, []byte(`var proxy = "PROXY a'\\\"\n;alert(1)//";`+"\n")) {
+		t.Errorf("pac with bad host: %.100s", body2)
+	}
+	r.Header.Set("If-None-Match", w.Header().Get("ETag"))
+	w = httptest.NewRecorder()
+	pacHandler(w, r)
+	if w.Code != 304 {
+		t.Errorf("If-None-Match: %d", w.Code)
+	}
+
+	// 没有列表时都交给gowalk
+	config.GoWalk.Gfwlist = ""
+	initPac()
+	if !bytes.Contains(pacScript, []byte("var defaultResult = proxy;")) {
+		t.Errorf("default result without gfwlist")
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// 探测每个appid时最多尝试的IP数
+	probeRetry = 3
+)
+
+var (
+	ErrAllIpBad = errors.New("all ip bad")
+)
+
+// 服务器端部署的版本或配置和客户端不一致，这个appid不能使用
+type MismatchError struct {
+	AppId  string
+	Reason string
+}
+
+func (e *MismatchError) Error() string {
+	return fmt.Sprintf("appid %s: %s", e.AppId, e.Reason)
+}
+
+// 读取服务器端GET应答里面的key:value
+func readServerInfo(resp *http.Response) (map[string]string, error) {
+	info := make(map[string]string)
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		kv := strings.SplitN(scanner.Text(), ":", 2)
+		if len(kv) == 2 {
+			info[kv[0]] = kv[1]
+		}
+	}
+	return info, scanner.Err()
+}
+
+func checkServerInfo(appid string, info map[string]string) error {
+	if info["protocol"] == "" {
+		return &MismatchError{appid, fmt.Sprintf("server version %s is too old, please redeploy the server", info["version"])}
+	}
+	protocol, err := strconv.Atoi(info["protocol"])
+	if err != nil {
+		return &MismatchError{appid, "bad protocol version: " + info["protocol"]}
+	}
+	if protocol != protocolVersion {
+		return &MismatchError{appid, fmt.Sprintf("server protocol version %d, client protocol version %d, please deploy the same version", protocol, protocolVersion)}
+	}
+	caps := make(map[string]bool)
+	for _, c := range strings.Split(info["caps"], ",") {
+		caps[c] = true
+	}
+	if !caps["sign"] {
+		return &MismatchError{appid, "server does not support request signing"}
+	}
+	if config.GoWalk.Encrypt && !caps["seal"] {
+		return &MismatchError{appid, "encrypt is enabled in gowalk.conf but not in server/config.go"}
+	}
+	if !config.GoWalk.Encrypt && caps["seal"] {
+		return &MismatchError{appid, "encrypt is enabled in server/config.go but not in gowalk.conf"}
+	}
+	if config.GoWalk.User == "" && caps["users"] {
+		return &MismatchError{appid, "server requires a user, please set user in gowalk.conf"}
+	}
+	if config.GoWalk.User != "" && !caps["users"] {
+		return &MismatchError{appid, "user is set in gowalk.conf but server/config.go has no users"}
+	}
+	return nil
+}
+
+// 检查appid对应的服务器端，网络错误时换IP重试
+func probeAppId(appid string) error {
+	var err error
+	for i := 0; i < probeRetry; i++ {
+		var ip = getGoodIp()
+		if ip == "" {
+			return ErrAllIpBad
+		}
+		var req *http.Request
+		req, err = http.NewRequest("GET", "https://"+ip, nil)
+		if err != nil {
+			return err
+		}
+		req.Host = appid + ".appspot.com"
+		var resp *http.Response
+		resp, err = client.Transport.RoundTrip(req)
+		if err != nil {
+			log.Println("Probe failed:", appid, ip, err)
+			suspCh <- ip
+			continue
+		}
+		if resp.StatusCode == http.StatusNotFound {
+			resp.Body.Close()
+			return &MismatchError{appid, "server not found, please check the appid"}
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			err = fmt.Errorf("status %d", resp.StatusCode)
+			continue
+		}
+		log.Println("Probe appid:", appid, ip, resp.Proto)
+		var info map[string]string
+		info, err = readServerInfo(resp)
+		resp.Body.Close()
+		if err != nil {
+			continue
+		}
+		return checkServerInfo(appid, info)
+	}
+	return err
+}
+
+// 启动时并发探测所有appid，去掉不匹配的appid
+// 网络原因探测失败的appid仍然保留
+func checkAppIds() {
+	var wg sync.WaitGroup
+	var errs = make([]error, len(config.GoWalk.AppId))
+	for i, appid := range config.GoWalk.AppId {
+		wg.Add(1)
+		go func(i int, appid string) {
+			defer wg.Done()
+			errs[i] = probeAppId(appid)
+		}(i, appid)
+	}
+	wg.Wait()
+
+	var appids []string
+	for i, appid := range config.GoWalk.AppId {
+		switch err := errs[i].(type) {
+		case nil:
+			appids = append(appids, appid)
+		case *MismatchError:
+			log.Println("AppId disabled:", err)
+		default:
+			log.Println("Probe appid failed:", appid, err)
+			appids = append(appids, appid)
+		}
+	}
+	if len(appids) == 0 {
+		log.Fatalln("No usable appid")
+	}
+	config.GoWalk.AppId = appids
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 规则匹配之后的处理方式
+const (
+	// 通过GAE获取
+	actionGAE = iota
+	// 直接连接google的IP
+	actionBypass
+	// 直接连接目标地址
+	actionDirect
+	// 直接断开连接
+	actionBlock
+	// 返回拒绝，http为403，SOCKS5为规则不允许
+	actionReject
+	// 通过上级代理连接目标地址
+	actionProxy
+)
+
+var actionNames = map[string]int{
+	"gae":    actionGAE,
+	"bypass": actionBypass,
+	"direct": actionDirect,
+	"block":  actionBlock,
+	"reject": actionReject,
+	"proxy":  actionProxy,
+}
+
+var (
+	ErrRuleAction = errors.New("unknown rule action")
+	ErrRuleProxy  = errors.New("proxy action needs proxy address")
+)
+
+/*
+路由规则，按顺序匹配，第一个匹配的规则决定如何处理，都不匹配时走GAE
+同一个规则里面设置的条件都要满足，每个条件的列表里面满足一个即可
+Hosts: ".google.com"匹配google.com和所有子域名，含有"*"时为通配符，其他为完整的域名
+Regexp: 匹配域名的正则表达式
+Nets: IP地址段，只匹配直接用IP访问的请求，不会解析域名
+Ports: 端口
+Paths: URL的路径，"*"为通配符，https的路径需要解密后才能知道
+*/
+type Rule struct {
+	Hosts  []string `toml:"hosts"`
+	Regexp string   `toml:"regexp"`
+	Nets   []string `toml:"nets"`
+	Ports  []int    `toml:"ports"`
+	Paths  []string `toml:"paths"`
+	Action string   `toml:"action"`
+	// action为proxy时的上级代理，参考proxyDialer
+	Proxy string `toml:"proxy"`
+	// 是否使用磁盘缓存，只对走GAE的请求有效，不设置时使用
+	Cache *bool `toml:"cache"`
+}
+
+type rule struct {
+	Rule
+	index  int
+	action int
+	re     *regexp.Regexp
+	nets   []*net.IPNet
+	dial   dialFunc
+	// 日志里面显示的代理地址，不包括用户名和密码
+	proxyAddr string
+	// direct和proxy在请求级别转发时使用
+	transport *http.Transport
+}
+
+// 没有匹配任何规则
+var defaultRule = &rule{Rule: Rule{Action: "gae"}, index: -1, action: actionGAE}
+
+var rules []*rule
+
+func compileRule(index int, r Rule) (*rule, error) {
+	var err error
+	c := &rule{Rule: r, index: index}
+	var ok bool
+	c.action, ok = actionNames[strings.ToLower(r.Action)]
+	if !ok {
+		return nil, ErrRuleAction
+	}
+	if r.Regexp != "" {
+		if c.re, err = regexp.Compile(r.Regexp); err != nil {
+			return nil, err
+		}
+	}
+	for _, s := range r.Nets {
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		c.nets = append(c.nets, n)
+	}
+	switch c.action {
+	case actionDirect:
+		c.dial = dialDirect
+	case actionProxy:
+		if r.Proxy == "" {
+			return nil, ErrRuleProxy
+		}
+		u, err := url.Parse(r.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		if c.dial, err = proxyDialer(u, dialDirect); err != nil {
+			return nil, err
+		}
+		c.proxyAddr = u.Scheme + "://" + u.Host
+	}
+	if c.dial != nil {
+		c.transport = &http.Transport{
+			Dial:                c.dial,
+			TLSHandshakeTimeout: 10 * time.Second,
+		}
+	}
+	return c, nil
+}
+
+// 编译配置里面的规则，旧的bypass配置转换为第一条规则
+func initRules() error {
+	var list []Rule
+	if len(config.GoWalk.ByPass) > 0 {
+		log.Println("bypass is deprecated, use rule with action = \"bypass\"")
+		list = append(list, Rule{Hosts: config.GoWalk.ByPass, Action: "bypass"})
+	}
+	list = append(list, config.GoWalk.Rules...)
+	rules = nil
+	for i, r := range list {
+		c, err := compileRule(i, r)
+		if err != nil {
+			return fmt.Errorf("rule %d: %v", i, err)
+		}
+		rules = append(rules, c)
+	}
+	return nil
+}
+
+// 通配符匹配，"*"匹配任意个字符
+func matchWildcard(pattern, s string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == s
+	}
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+	last := parts[len(parts)-1]
+	for _, p := range parts[1 : len(parts)-1] {
+		i := strings.Index(s, p)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(p):]
+	}
+	return len(s) >= len(last) && strings.HasSuffix(s, last)
+}
+
+func (r *rule) matchHost(host string) bool {
+	if len(r.Hosts) > 0 {
+		ok := false
+		for _, p := range r.Hosts {
+			p = strings.ToLower(p)
+			switch {
+			case strings.HasPrefix(p, "."):
+				ok = matchDomain([]string{p}, host)
+			case strings.Contains(p, "*"):
+				ok = matchWildcard(p, host)
+			default:
+				ok = p == host
+			}
+			if ok {
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	if r.re != nil && !r.re.MatchString(host) {
+		return false
+	}
+	if len(r.nets) > 0 {
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return false
+		}
+		ok := false
+		for _, n := range r.nets {
+			if n.Contains(ip) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *rule) matchPort(port int) bool {
+	if len(r.Ports) == 0 {
+		return true
+	}
+	for _, p := range r.Ports {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *rule) matchPath(path string) bool {
+	if len(r.Paths) == 0 {
+		return true
+	}
+	for _, p := range r.Paths {
+		if matchWildcard(p, path) {
+			return true
+		}
+	}
+	return false
+}
+
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.Trim(host, "[]")), ".")
+}
+
+// 隧道建立时还不知道请求的路径
+// 设置了paths的规则可能匹配时返回nil，由隧道里面的每个请求再判断
+func connRule(host string, port string) *rule {
+	host = normalizeHost(host)
+	p, _ := strconv.Atoi(port)
+	for _, r := range rules {
+		if !r.matchHost(host) || !r.matchPort(p) {
+			continue
+		}
+		if len(r.Paths) > 0 {
+			return nil
+		}
+		return r
+	}
+	return defaultRule
+}
+
+// 不是http的连接没有路径，跳过设置了paths的规则
+func streamRule(host string, port string) *rule {
+	host = normalizeHost(host)
+	p, _ := strconv.Atoi(port)
+	for _, r := range rules {
+		if len(r.Paths) == 0 && r.matchHost(host) && r.matchPort(p) {
+			return r
+		}
+	}
+	return defaultRule
+}
+
+func urlRule(u *url.URL) *rule {
+	host := normalizeHost(u.Hostname())
+	port, _ := strconv.Atoi(u.Port())
+	if port == 0 {
+		port = 80
+		if u.Scheme == "https" {
+			port = 443
+		}
+	}
+	for _, r := range rules {
+		if r.matchHost(host) && r.matchPort(port) && r.matchPath(u.Path) {
+			return r
+		}
+	}
+	return defaultRule
+}
+
+// 代理的请求，https解密后的请求只有路径，域名在Host里面
+func requestRule(r *http.Request) *rule {
+	u := *r.URL
+	if u.Scheme == "" {
+		u.Scheme = "https"
+	}
+	if u.Host == "" {
+		u.Host = r.Host
+	}
+	return urlRule(&u)
+}
+
+func (r *rule) String() string {
+	if r.index < 0 {
+		return "default " + r.Action
+	}
+	s := fmt.Sprintf("rule %d %s", r.index, r.Action)
+	if r.action == actionProxy {
+		s += " " + r.proxyAddr
+	}
+	return s
+}
+
+// 查看URL匹配的规则，比如 /_~_/rule?url=https://www.google.com/
+func ruleTestPage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	u, err := url.Parse(r.URL.Query().Get("url"))
+	if err != nil || u.Host == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, "usage: /_~_/rule?url=https://www.example.com/path")
+		return
+	}
+	matched := urlRule(u)
+	fmt.Fprintln(w, u.String())
+	fmt.Fprintln(w, matched.String())
+	if matched.index >= 0 {
+		c := matched.Rule
+		c.Proxy = matched.proxyAddr
+		fmt.Fprintf(w, "%+v\n", c)
+	}
+}
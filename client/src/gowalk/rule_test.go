@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestMatchWildcard(t *testing.T) {
+	for _, tt := range []struct {
+		pattern, s string
+		ok         bool
+	}{
+		{"www.google.com", "www.google.com", true},
+		{"www.google.com", "www.google.co", false},
+		{"*", "", true},
+		{"*", "anything", true},
+		{"*.google.com", "www.google.com", true},
+		{"*.google.com", "google.com", false},
+		{"*.google.com", "www.google.com.evil.org", false},
+		{"www.google.*", "www.google.com.hk", true},
+		{"*google*", "www.google.com", true},
+		{"a*b*c", "abc", true},
+		{"a*b*c", "aXbYc", true},
+		{"a*b*c", "acb", false},
+		{"a*b*b", "ab", false},
+		{"a*b*b", "abxb", true},
+		{"/ajax/*", "/ajax/x/y", true},
+		{"/ajax/*", "/ajax", false},
+		{"*.js", "/a/b.js", true},
+		{"*.js", "/a/b.json", false},
+	} {
+		if ok := matchWildcard(tt.pattern, tt.s); ok != tt.ok {
+			t.Errorf("matchWildcard(%q, %q) = %v, want %v", tt.pattern, tt.s, ok, tt.ok)
+		}
+	}
+}
+
+func TestRuleMatch(t *testing.T) {
+	defer func(r []*rule, b []string, c []Rule) {
+		rules, config.GoWalk.ByPass, config.GoWalk.Rules = r, b, c
+	}(rules, config.GoWalk.ByPass, config.GoWalk.Rules)
+	config.GoWalk.ByPass = []string{".googleapis.com"}
+	config.GoWalk.Rules = []Rule{
+		{Hosts: []string{".google.com"}, Paths: []string{"/search*"}, Action: "gae"},
+		{Hosts: []string{".google.com"}, Action: "bypass"},
+		{Hosts: []string{"*.example.*"}, Ports: []int{8080}, Action: "direct"},
+		{Regexp: `^ads?\.`, Action: "block"},
+		{Nets: []string{"10.0.0.0/8", "192.168.1.1"}, Action: "reject"},
+		{Hosts: []string{"local.test"}, Action: "proxy", Proxy: "socks5://127.0.0.1:1080"},
+	}
+	if err := initRules(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 规则的序号，-1为默认规则，-2为nil
+	index := func(r *rule) int {
+		if r == nil {
+			return -2
+		}
+		return r.index
+	}
+	for _, tt := range []struct {
+		host, port   string
+		conn, stream int
+	}{
+		{"fonts.googleapis.com", "443", 0, 0},
+		{"www.google.com", "443", -2, 2},
+		{"WWW.Google.COM.", "443", -2, 2},
+		{"google.com", "80", -2, 2},
+		{"www.example.org", "8080", 3, 3},
+		{"www.example.org", "443", -1, -1},
+		{"ad.example.net", "443", 4, 4},
+		{"10.1.2.3", "443", 5, 5},
+		{"[192.168.1.1]", "80", 5, 5},
+		{"192.168.1.2", "80", -1, -1},
+		{"local.test", "22", 6, 6},
+		{"www.github.com", "443", -1, -1},
+	} {
+		if got := index(connRule(tt.host, tt.port)); got != tt.conn {
+			t.Errorf("connRule(%s, %s) = %d, want %d", tt.host, tt.port, got, tt.conn)
+		}
+		if got := index(streamRule(tt.host, tt.port)); got != tt.stream {
+			t.Errorf("streamRule(%s, %s) = %d, want %d", tt.host, tt.port, got, tt.stream)
+		}
+	}
+
+	for _, tt := range []struct {
+		url  string
+		rule int
+	}{
+		{"https://www.google.com/search?q=1", 1},
+		{"https://www.google.com/maps", 2},
+		{"http://www.example.com:8080/", 3},
+		{"http://www.example.com/", -1},
+		{"http://[::1]/", -1},
+		{"http://local.test/", 6},
+	} {
+		u, _ := url.Parse(tt.url)
+		if got := index(urlRule(u)); got != tt.rule {
+			t.Errorf("urlRule(%s) = %d, want %d", tt.url, got, tt.rule)
+		}
+	}
+
+	// https解密之后的请求只有路径
+	r, _ := http.NewRequest("GET", "/search", nil)
+	r.Host = "www.google.com"
+	if got := index(requestRule(r)); got != 1 {
+		t.Errorf("requestRule = %d, want 1", got)
+	}
+}
+
+func TestCompileRule(t *testing.T) {
+	for _, tt := range []struct {
+		rule Rule
+		err  bool
+	}{
+		{Rule{Action: "GAE"}, false},
+		{Rule{Action: "unknown"}, true},
+		{Rule{Action: "proxy"}, true},
+		{Rule{Action: "proxy", Proxy: "ftp://a"}, true},
+		{Rule{Action: "direct", Regexp: "("}, true},
+		{Rule{Action: "direct", Nets: []string{"10.0.0.0/33"}}, true},
+		{Rule{Action: "direct", Nets: []string{"::1"}}, false},
+	} {
+		if _, err := compileRule(0, tt.rule); (err != nil) != tt.err {
+			t.Errorf("%+v: %v", tt.rule, err)
+		}
+	}
+}
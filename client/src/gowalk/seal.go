@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"github.com/nybuxtsui/ca/third_party/code.google.com/p/go.crypto/hkdf"
+	"github.com/nybuxtsui/ca/third_party/code.google.com/p/go.crypto/nacl/secretbox"
+	"io"
+)
+
+var (
+	// 配置了加密，但收到的帧没有加密
+	ErrUnsealed = errors.New("unsealed")
+	// 解密失败，密码不一致或者数据被篡改
+	ErrOpen = errors.New("open")
+	// 帧里面的用户名没有配置
+	ErrUnknownUser = errors.New("unknown user")
+
+	// 加密的密钥，为nil表示不加密
+	sealKey *[32]byte
+	// 根据用户名查找用户的加密和签名密钥，服务器端配置了多个用户时设置
+	lookupKeys func(user string) (seal, sign *[32]byte, err error)
+)
+
+const (
+	// 加密记录的明文长度
+	sealRecordSize = 64 * 1024
+	// nonce的随机部分长度，剩下8字节为记录序号
+	sealPrefixSize = 16
+	// 序号的最高位标记最后一个记录，防止截断
+	sealFinalFlag = 1 << 63
+)
+
+// 用hkdf从共享密码派生加密密钥
+func deriveKey(password string, info string) *[32]byte {
+	var key [32]byte
+	r := hkdf.New(sha256.New, []byte(password), []byte("gowalk"), []byte(info))
+	if _, err := io.ReadFull(r, key[:]); err != nil {
+		panic(err)
+	}
+	return &key
+}
+
+// 帧使用的密钥，没有设置lookupKeys时使用sealKey和signKey
+func userKeys(user string) (seal, sign *[32]byte, err error) {
+	if lookupKeys == nil {
+		return sealKey, signKey, nil
+	}
+	return lookupKeys(user)
+}
+
+/*
+加密的内容分为多个记录，以便流式处理
+nonce前缀(16字节随机数)
+之后为若干记录: uvarint长度 + secretbox密文
+每个记录的nonce为 前缀 + 8字节序号
+*/
+type sealWriter struct {
+	w      io.Writer
+	key    *[32]byte
+	nonce  [24]byte
+	seq    uint64
+	buf    []byte
+	sealed []byte
+}
+
+func newSealWriter(w io.Writer, key *[32]byte) (*sealWriter, error) {
+	sw := &sealWriter{
+		w:   w,
+		key: key,
+		buf: make([]byte, 0, sealRecordSize),
+	}
+	if _, err := io.ReadFull(rand.Reader, sw.nonce[:sealPrefixSize]); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(sw.nonce[:sealPrefixSize]); err != nil {
+		return nil, err
+	}
+	return sw, nil
+}
+
+func (sw *sealWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		if len(sw.buf) == cap(sw.buf) {
+			if err = sw.flush(false); err != nil {
+				return
+			}
+		}
+		c := copy(sw.buf[len(sw.buf):cap(sw.buf)], p)
+		sw.buf = sw.buf[:len(sw.buf)+c]
+		p = p[c:]
+		n += c
+	}
+	return
+}
+
+func (sw *sealWriter) flush(final bool) error {
+	seq := sw.seq
+	if final {
+		seq |= sealFinalFlag
+	}
+	sw.seq++
+	binary.BigEndian.PutUint64(sw.nonce[sealPrefixSize:], seq)
+	sw.sealed = secretbox.Seal(sw.sealed[:0], sw.buf, &sw.nonce, sw.key)
+	sw.buf = sw.buf[:0]
+
+	var size [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(size[:], uint64(len(sw.sealed)))
+	if _, err := sw.w.Write(size[:n]); err != nil {
+		return err
+	}
+	_, err := sw.w.Write(sw.sealed)
+	return err
+}
+
+// 写入最后一个记录，不关闭下层的Writer
+func (sw *sealWriter) Close() error {
+	return sw.flush(true)
+}
+
+type openReader struct {
+	r     *bufio.Reader
+	key   *[32]byte
+	nonce [24]byte
+	seq   uint64
+	final bool
+	buf   []byte
+	plain []byte
+}
+
+func newOpenReader(r *bufio.Reader, key *[32]byte) (*openReader, error) {
+	or := &openReader{r: r, key: key}
+	if _, err := io.ReadFull(r, or.nonce[:sealPrefixSize]); err != nil {
+		return nil, unexpected(err)
+	}
+	return or, nil
+}
+
+func (or *openReader) Read(p []byte) (n int, err error) {
+	for len(or.plain) == 0 {
+		if or.final {
+			return 0, io.EOF
+		}
+		if err = or.next(); err != nil {
+			return 0, err
+		}
+	}
+	n = copy(p, or.plain)
+	or.plain = or.plain[n:]
+	return
+}
+
+func (or *openReader) next() error {
+	size, err := binary.ReadUvarint(or.r)
+	if err != nil {
+		return unexpected(err)
+	}
+	if size > sealRecordSize+secretbox.Overhead {
+		return ErrFormat
+	}
+	if uint64(cap(or.buf)) < size {
+		or.buf = make([]byte, size)
+	}
+	or.buf = or.buf[:size]
+	if _, err = io.ReadFull(or.r, or.buf); err != nil {
+		return unexpected(err)
+	}
+	// 先按普通记录解密，失败再按最后一个记录解密
+	for _, flag := range []uint64{0, sealFinalFlag} {
+		binary.BigEndian.PutUint64(or.nonce[sealPrefixSize:], or.seq|flag)
+		plain, ok := secretbox.Open(nil, or.buf, &or.nonce, or.key)
+		if ok {
+			or.seq++
+			or.plain = plain
+			or.final = flag != 0
+			return nil
+		}
+	}
+	return ErrOpen
+}
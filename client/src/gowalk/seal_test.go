@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+// 加密后的记录，不包括nonce前缀
+func sealRecords(t *testing.T, key *[32]byte, plain []byte) (prefix []byte, records [][]byte) {
+	var buff bytes.Buffer
+	sw, err := newSealWriter(&buff, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sw.Write(plain)
+	if err = sw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r := bytes.NewReader(buff.Bytes())
+	prefix = make([]byte, sealPrefixSize)
+	io.ReadFull(r, prefix)
+	for r.Len() > 0 {
+		size, _ := binary.ReadUvarint(r)
+		record := make([]byte, size)
+		io.ReadFull(r, record)
+		var head [binary.MaxVarintLen64]byte
+		n := binary.PutUvarint(head[:], size)
+		records = append(records, append(head[:n], record...))
+	}
+	return
+}
+
+func openAll(key *[32]byte, prefix []byte, records [][]byte) ([]byte, error) {
+	b := append([]byte(nil), prefix...)
+	for _, r := range records {
+		b = append(b, r...)
+	}
+	or, err := newOpenReader(bufio.NewReader(bytes.NewReader(b)), key)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(or)
+}
+
+func TestSealOpen(t *testing.T) {
+	key := deriveKey("password", "secretbox")
+	plain := bytes.Repeat([]byte("sealed data "), sealRecordSize/4+10)
+	prefix, records := sealRecords(t, key, plain)
+	if len(records) != 4 {
+		t.Fatalf("%d records, want 4", len(records))
+	}
+	tests := []struct {
+		name    string
+		key     *[32]byte
+		records [][]byte
+		ok      bool
+	}{
+		{"complete", key, records, true},
+		{"wrong key", deriveKey("other", "secretbox"), records, false},
+		{"truncated", key, records[:3], false},
+		{"dropped", key, [][]byte{records[0], records[2], records[3]}, false},
+		{"reordered", key, [][]byte{records[1], records[0], records[2], records[3]}, false},
+	}
+	for _, tt := range tests {
+		got, err := openAll(tt.key, prefix, tt.records)
+		if tt.ok {
+			if err != nil || !bytes.Equal(got, plain) {
+				t.Errorf("%s: %d bytes, %v", tt.name, len(got), err)
+			}
+		} else if err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+}
+
+func TestSealedFrame(t *testing.T) {
+	defer func(k *[32]byte) { sealKey = k }(sealKey)
+	key := deriveKey("password", "secretbox")
+	data := &HttpData{Method: "GET", Url: "http://a/", Header: http.Header{"Content-Type": {"text/html"}}}
+
+	sealKey = key
+	sealed := encodeFrame(t, data)
+	if sealed[3]&flagSealed == 0 || sealed[3]&flagCompression != flagDeflate {
+		t.Errorf("sealed flags %#x", sealed[3])
+	}
+	if _, err := decode(bytes.NewReader(sealed)); err != nil {
+		t.Errorf("sealed: %v", err)
+	}
+
+	sealKey = nil
+	plain := encodeFrame(t, data)
+	if _, err := decode(bytes.NewReader(sealed)); err != ErrOpen {
+		t.Errorf("sealed frame without key: %v", err)
+	}
+
+	sealKey = key
+	if _, err := decode(bytes.NewReader(plain)); err != ErrUnsealed {
+		t.Errorf("unsealed frame with key: %v", err)
+	}
+
+	sealKey = deriveKey("other", "secretbox")
+	if _, err := decode(bytes.NewReader(sealed)); err != ErrOpen {
+		t.Errorf("wrong key: %v", err)
+	}
+}
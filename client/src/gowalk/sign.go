@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+var (
+	// 签名不匹配
+	ErrSignature = errors.New("signature")
+	// 时间戳超出允许的范围
+	ErrExpired = errors.New("expired")
+
+	// 签名的密钥，由共享密码派生
+	signKey *[32]byte
+)
+
+const (
+	// 允许的客户端和服务器端时间误差
+	maxClockSkew = 5 * time.Minute
+	// nonce的长度
+	nonceSize = 16
+)
+
+// 签名的内容为 user, method, url, 头部, body的sha256, 时间戳, nonce
+// 以及影响服务器端处理方式的选项: compressMinSize, compressLevel, autoRange, parallel
+// status, error这些只在应答里面出现的字段不签名，应答由加密保护
+// 每项都带长度前缀，避免拼接产生歧义
+func signature(key *[32]byte, data *HttpData, body []byte) string {
+	digest := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, key[:])
+	fw := &frameWriter{w: mac}
+	fw.writeString(data.User)
+	fw.writeString(data.Method)
+	fw.writeString(data.Url)
+	writeHeaderMAC(fw, data.Header)
+	fw.write(digest[:])
+	fw.writeUvarint(uint64(data.Timestamp))
+	fw.writeString(data.Nonce)
+	fw.writeUvarint(uint64(data.CompressMinSize))
+	fw.writeUvarint(uint64(data.CompressLevel))
+	if data.AutoRange {
+		fw.writeUvarint(1)
+	} else {
+		fw.writeUvarint(0)
+	}
+	fw.writeUvarint(uint64(data.Parallel))
+	return string(mac.Sum(nil))
+}
+
+// 头部按规范化的名字排序，同名的值保持原来的顺序
+func writeHeaderMAC(fw *frameWriter, h http.Header) {
+	canonical := make(http.Header, len(h))
+	names := make([]string, 0, len(h))
+	for k := range h {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		if len(h[k]) == 0 {
+			// 没有值的头部不会编码到帧里面
+			continue
+		}
+		ck := http.CanonicalHeaderKey(k)
+		canonical[ck] = append(canonical[ck], h[k]...)
+	}
+	names = names[:0]
+	for k := range canonical {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	fw.writeUvarint(uint64(len(names)))
+	for _, k := range names {
+		fw.writeString(k)
+		fw.writeUvarint(uint64(len(canonical[k])))
+		for _, v := range canonical[k] {
+			fw.writeString(v)
+		}
+	}
+}
+
+// 填写时间戳、nonce和签名，body会被重新设置，所以同一个请求可以多次签名发送
+func signRequest(data *HttpData, body []byte) error {
+	_, key, err := userKeys(data.User)
+	if err != nil {
+		return err
+	}
+	var nonce [nonceSize]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return err
+	}
+	data.Timestamp = time.Now().Unix()
+	data.Nonce = string(nonce[:])
+	data.Signature = signature(key, data, body)
+	data.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return nil
+}
+
+// 读取全部body后校验签名和时间戳，校验通过后body可以重新读取
+// nonce是否重复由调用者检查
+func verifyRequest(data *HttpData) error {
+	body, err := ioutil.ReadAll(data.Body)
+	if err != nil {
+		return err
+	}
+	data.Body.Close()
+	data.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	_, key, err := userKeys(data.User)
+	if err != nil {
+		return err
+	}
+	if len(data.Nonce) != nonceSize {
+		return ErrSignature
+	}
+	if !hmac.Equal([]byte(data.Signature), []byte(signature(key, data, body))) {
+		return ErrSignature
+	}
+	skew := time.Since(time.Unix(data.Timestamp, 0))
+	if skew > maxClockSkew || skew < -maxClockSkew {
+		return ErrExpired
+	}
+	return nil
+}
+
+// 状态请求是普通的GET，没有帧，签名放在头部里面
+const statusPath = "/status"
+
+// 给状态请求签名，签名的内容和普通请求相同，method为GET，url为statusPath，body为空
+func signStatus(h http.Header, user string) error {
+	data := &HttpData{User: user, Method: "GET", Url: statusPath}
+	if err := signRequest(data, nil); err != nil {
+		return err
+	}
+	h.Set("X-GW-User", data.User)
+	h.Set("X-GW-Timestamp", strconv.FormatInt(data.Timestamp, 10))
+	h.Set("X-GW-Nonce", hex.EncodeToString([]byte(data.Nonce)))
+	h.Set("X-GW-Signature", hex.EncodeToString([]byte(data.Signature)))
+	return nil
+}
+
+// 从头部读出状态请求的签名，由verifyRequest校验
+func readStatusRequest(h http.Header) (*HttpData, error) {
+	data := &HttpData{User: h.Get("X-GW-User"), Method: "GET", Url: statusPath}
+	var err error
+	data.Timestamp, err = strconv.ParseInt(h.Get("X-GW-Timestamp"), 10, 64)
+	if err != nil {
+		return nil, ErrSignature
+	}
+	nonce, err := hex.DecodeString(h.Get("X-GW-Nonce"))
+	if err != nil {
+		return nil, ErrSignature
+	}
+	signature, err := hex.DecodeString(h.Get("X-GW-Signature"))
+	if err != nil {
+		return nil, ErrSignature
+	}
+	data.Nonce = string(nonce)
+	data.Signature = string(signature)
+	data.Body = ioutil.NopCloser(bytes.NewReader(nil))
+	return data, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func signedRequest(t *testing.T, body []byte) *HttpData {
+	data := &HttpData{
+		User:            "alice",
+		Method:          "POST",
+		Url:             "https://www.example.com/",
+		Header:          http.Header{"Content-Type": {"text/plain"}, "Range": {"bytes=0-99"}},
+		CompressMinSize: 1024,
+		AutoRange:       true,
+		Parallel:        4,
+	}
+	if err := signRequest(data, body); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestSignVerify(t *testing.T) {
+	defer func(k *[32]byte) { signKey = k }(signKey)
+	signKey = deriveKey("password", "hmac")
+	body := []byte("request body")
+
+	tests := []struct {
+		name   string
+		tamper func(d *HttpData)
+		err    error
+	}{
+		{"valid", func(d *HttpData) {}, nil},
+		{"user", func(d *HttpData) { d.User = "bob" }, ErrSignature},
+		{"method", func(d *HttpData) { d.Method = "GET" }, ErrSignature},
+		{"url", func(d *HttpData) { d.Url = "https://www.example.com/x" }, ErrSignature},
+		{"header", func(d *HttpData) { d.Header.Set("Range", "bytes=0-") }, ErrSignature},
+		{"added header", func(d *HttpData) { d.Header.Set("Cookie", "a=b") }, ErrSignature},
+		{"header case", func(d *HttpData) {
+			d.Header = http.Header{"content-type": {"text/plain"}, "Range": {"bytes=0-99"}}
+		}, nil},
+		{"empty header", func(d *HttpData) { d.Header["X-Empty"] = nil }, nil},
+		{"body", func(d *HttpData) { d.Body = ioutil.NopCloser(bytes.NewReader([]byte("other"))) }, ErrSignature},
+		{"auto range", func(d *HttpData) { d.AutoRange = false }, ErrSignature},
+		{"parallel", func(d *HttpData) { d.Parallel = 8 }, ErrSignature},
+		{"compress level", func(d *HttpData) { d.CompressLevel = 9 }, ErrSignature},
+		{"compress min size", func(d *HttpData) { d.CompressMinSize = 0 }, ErrSignature},
+		{"nonce", func(d *HttpData) { d.Nonce = "0123456789abcdef" }, ErrSignature},
+		{"short nonce", func(d *HttpData) { d.Nonce = "x" }, ErrSignature},
+		{"timestamp", func(d *HttpData) { d.Timestamp++ }, ErrSignature},
+		{"key", func(d *HttpData) {
+			signKey = deriveKey("other", "hmac")
+		}, ErrSignature},
+	}
+	for _, tt := range tests {
+		signKey = deriveKey("password", "hmac")
+		data := signedRequest(t, body)
+		tt.tamper(data)
+		if err := verifyRequest(data); err != tt.err {
+			t.Errorf("%s: %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestSignClockSkew(t *testing.T) {
+	defer func(k *[32]byte) { signKey = k }(signKey)
+	signKey = deriveKey("password", "hmac")
+	for _, tt := range []struct {
+		skew time.Duration
+		err  error
+	}{
+		{0, nil},
+		{maxClockSkew - time.Minute, nil},
+		{-maxClockSkew + time.Minute, nil},
+		{maxClockSkew + time.Minute, ErrExpired},
+		{-maxClockSkew - time.Minute, ErrExpired},
+	} {
+		data := signedRequest(t, nil)
+		// 按偏移后的时间戳重新签名
+		data.Timestamp -= int64(tt.skew / time.Second)
+		data.Signature = signature(signKey, data, nil)
+		if err := verifyRequest(data); err != tt.err {
+			t.Errorf("skew %v: %v, want %v", tt.skew, err, tt.err)
+		}
+	}
+}
+
+func TestSignStatus(t *testing.T) {
+	defer func(k *[32]byte) { signKey = k }(signKey)
+	signKey = deriveKey("password", "hmac")
+	h := make(http.Header)
+	if err := signStatus(h, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	data, err := readStatusRequest(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = verifyRequest(data); err != nil {
+		t.Errorf("status: %v", err)
+	}
+	h.Set("X-GW-User", "bob")
+	data, _ = readStatusRequest(h)
+	if err = verifyRequest(data); err != ErrSignature {
+		t.Errorf("status user changed: %v", err)
+	}
+}
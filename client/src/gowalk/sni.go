@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+)
+
+const (
+	// TLS记录头的长度: type(1) + version(2) + length(2)
+	tlsRecordHeaderLen = 5
+	tlsRecordHandshake = 0x16
+	tlsClientHello     = 1
+	tlsExtServerName   = 0
+	tlsServerNameHost  = 0
+)
+
+var (
+	ErrNoSNI = errors.New("no sni")
+)
+
+// 从第一个TLS记录里面的ClientHello读出SNI，不消耗r里面的内容
+// ClientHello超过bufio的缓冲区或者被分成多个记录时返回ErrNoSNI
+func peekSNI(r *bufio.Reader) (string, error) {
+	head, err := r.Peek(tlsRecordHeaderLen)
+	if err != nil {
+		return "", err
+	}
+	if head[0] != tlsRecordHandshake {
+		return "", ErrNoSNI
+	}
+	size := int(head[3])<<8 | int(head[4])
+	record, err := r.Peek(tlsRecordHeaderLen + size)
+	if err != nil {
+		if err == bufio.ErrBufferFull {
+			return "", ErrNoSNI
+		}
+		return "", err
+	}
+	return parseClientHello(record[tlsRecordHeaderLen:])
+}
+
+// 按顺序读取ClientHello的字段，越界时ok为false
+type helloReader struct {
+	b  []byte
+	ok bool
+}
+
+func (h *helloReader) skip(n int) {
+	if !h.ok || n > len(h.b) {
+		h.ok = false
+		return
+	}
+	h.b = h.b[n:]
+}
+
+func (h *helloReader) read(n int) []byte {
+	if !h.ok || n > len(h.b) {
+		h.ok = false
+		return nil
+	}
+	v := h.b[:n]
+	h.b = h.b[n:]
+	return v
+}
+
+func (h *helloReader) uint8() int {
+	v := h.read(1)
+	if v == nil {
+		return 0
+	}
+	return int(v[0])
+}
+
+func (h *helloReader) uint16() int {
+	v := h.read(2)
+	if v == nil {
+		return 0
+	}
+	return int(v[0])<<8 | int(v[1])
+}
+
+/*
+ClientHello格式，参考RFC 5246 7.4.1.2和RFC 6066 3
+handshake type(1) + length(3) + version(2) + random(32)
+session id(1字节长度) + cipher suites(2字节长度) + compression methods(1字节长度)
+extensions(2字节长度)，每个为 type(2) + length(2) + data
+server_name: list length(2)，每项为 name type(1) + length(2) + name
+*/
+func parseClientHello(b []byte) (string, error) {
+	h := &helloReader{b, true}
+	if h.uint8() != tlsClientHello {
+		return "", ErrNoSNI
+	}
+	h.skip(3 + 2 + 32)
+	h.skip(h.uint8())
+	h.skip(h.uint16())
+	h.skip(h.uint8())
+	ext := &helloReader{h.read(h.uint16()), h.ok}
+	for ext.ok && len(ext.b) > 0 {
+		t := ext.uint16()
+		data := &helloReader{ext.read(ext.uint16()), ext.ok}
+		if t != tlsExtServerName {
+			continue
+		}
+		list := &helloReader{data.read(data.uint16()), data.ok}
+		for list.ok && len(list.b) > 0 {
+			nameType := list.uint8()
+			name := list.read(list.uint16())
+			if list.ok && nameType == tlsServerNameHost && len(name) > 0 {
+				return string(name), nil
+			}
+		}
+	}
+	return "", ErrNoSNI
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+)
+
+// 抓取crypto/tls发出的第一个TLS记录，也就是ClientHello
+func clientHello(t *testing.T, serverName string) []byte {
+	server, client := net.Pipe()
+	defer server.Close()
+	go tls.Client(client, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}).Handshake()
+	head := make([]byte, tlsRecordHeaderLen)
+	if _, err := io.ReadFull(server, head); err != nil {
+		t.Fatal(err)
+	}
+	body := make([]byte, int(head[3])<<8|int(head[4]))
+	if _, err := io.ReadFull(server, body); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	return append(head, body...)
+}
+
+func TestPeekSNI(t *testing.T) {
+	hello := clientHello(t, "www.google.com")
+	tests := []struct {
+		name string
+		data []byte
+		size int
+		sni  string
+		err  error
+	}{
+		{"sni", hello, 4096, "www.google.com", nil},
+		{"no sni", clientHello(t, ""), 4096, "", ErrNoSNI},
+		{"http", []byte("GET / HTTP/1.1\r\nHost: a\r\n\r\n"), 4096, "", ErrNoSNI},
+		{"small buffer", hello, 64, "", ErrNoSNI},
+		{"truncated", hello[:len(hello)-10], 4096, "", io.EOF},
+		{"short head", hello[:3], 4096, "", io.EOF},
+	}
+	for _, tt := range tests {
+		r := bufio.NewReaderSize(bytes.NewReader(tt.data), tt.size)
+		sni, err := peekSNI(r)
+		if sni != tt.sni || err != tt.err {
+			t.Errorf("%s: %q %v, want %q %v", tt.name, sni, err, tt.sni, tt.err)
+		}
+		// 不能消耗r里面的内容
+		if b, _ := r.Peek(1); len(b) == 0 || b[0] != tt.data[0] {
+			t.Errorf("%s: data consumed", tt.name)
+		}
+	}
+}
+
+func TestParseClientHello(t *testing.T) {
+	hello := clientHello(t, "example.com")[tlsRecordHeaderLen:]
+	// 任何位置截断或者长度字段出错都不能越界
+	for i := 0; i < len(hello); i++ {
+		if sni, err := parseClientHello(hello[:i]); err == nil && sni != "example.com" {
+			t.Errorf("truncated at %d: %q", i, sni)
+		}
+		b := append([]byte(nil), hello...)
+		b[i] = 0xff
+		parseClientHello(b)
+	}
+	if _, err := parseClientHello([]byte{2, 0, 0, 0}); err != ErrNoSNI {
+		t.Errorf("server hello: %v", err)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"time"
+)
+
+// SOCKS5协议，参考RFC 1928和RFC 1929
+const (
+	socksVersion = 5
+	// 用户名密码认证的子协议版本
+	socksAuthVersion = 1
+
+	socksMethodNone     = 0
+	socksMethodPassword = 2
+	socksMethodNoAccept = 0xff
+
+	socksCmdConnect = 1
+
+	socksAtypIPv4   = 1
+	socksAtypDomain = 3
+	socksAtypIPv6   = 4
+
+	socksReplySucceeded           = 0
+	socksReplyNotAllowed          = 2
+	socksReplyCommandNotSupported = 7
+	socksReplyAddrNotSupported    = 8
+
+	// 握手的超时时间
+	socksHandshakeTimeout = 30 * time.Second
+)
+
+var (
+	ErrSocksVersion = errors.New("socks version not supported")
+	ErrSocksAuth    = errors.New("socks auth failed")
+	ErrSocksCommand = errors.New("socks command not supported")
+	ErrSocksAddr    = errors.New("socks address type not supported")
+)
+
+// SOCKS5代理，只支持CONNECT，连接和CONNECT代理一样由dispatch分发
+func (h *handler) serveSocks(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if e, ok := err.(net.Error); ok && e.Temporary() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go h.onSocks(conn)
+	}
+}
+
+func (h *handler) onSocks(conn net.Conn) {
+	r := bufio.NewReaderSize(conn, tunnelBufferSize)
+	conn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	host, port, err := socksHandshake(conn, r)
+	if err != nil {
+		log.Println("SOCKS handshake failed:", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	// SNI可能和请求的地址不同，dispatch里面会再判断一次
+	if rule := connRule(host, port); rule != nil && rule.action == actionReject {
+		log.Println("REJECT:", net.JoinHostPort(host, port), rule)
+		socksReply(conn, socksReplyNotAllowed)
+		conn.Close()
+		return
+	}
+	if err = socksReply(conn, socksReplySucceeded); err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	log.Println("SOCKS:", net.JoinHostPort(host, port))
+	h.dispatch(conn, r, host, port)
+}
+
+// 完成认证和读取CONNECT请求，返回目标地址
+func socksHandshake(conn net.Conn, r *bufio.Reader) (host string, port string, err error) {
+	// 认证方法协商: VER NMETHODS METHODS
+	var head [2]byte
+	if _, err = io.ReadFull(r, head[:]); err != nil {
+		return
+	}
+	if head[0] != socksVersion {
+		return "", "", ErrSocksVersion
+	}
+	methods := make([]byte, head[1])
+	if _, err = io.ReadFull(r, methods); err != nil {
+		return
+	}
+	var want byte = socksMethodNone
+	if config.GoWalk.SocksUser != "" {
+		want = socksMethodPassword
+	}
+	var method byte = socksMethodNoAccept
+	for _, m := range methods {
+		if m == want {
+			method = want
+		}
+	}
+	if _, err = conn.Write([]byte{socksVersion, method}); err != nil {
+		return
+	}
+	if method == socksMethodNoAccept {
+		return "", "", ErrSocksAuth
+	}
+	if method == socksMethodPassword {
+		if err = socksAuth(conn, r); err != nil {
+			return
+		}
+	}
+
+	// 请求: VER CMD RSV ATYP DST.ADDR DST.PORT
+	var req [4]byte
+	if _, err = io.ReadFull(r, req[:]); err != nil {
+		return
+	}
+	if req[0] != socksVersion {
+		return "", "", ErrSocksVersion
+	}
+	if req[1] != socksCmdConnect {
+		socksReply(conn, socksReplyCommandNotSupported)
+		return "", "", ErrSocksCommand
+	}
+	switch req[3] {
+	case socksAtypIPv4, socksAtypIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if req[3] == socksAtypIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err = io.ReadFull(r, ip); err != nil {
+			return
+		}
+		host = ip.String()
+	case socksAtypDomain:
+		var size byte
+		if size, err = r.ReadByte(); err != nil {
+			return
+		}
+		name := make([]byte, size)
+		if _, err = io.ReadFull(r, name); err != nil {
+			return
+		}
+		host = string(name)
+	default:
+		socksReply(conn, socksReplyAddrNotSupported)
+		return "", "", ErrSocksAddr
+	}
+	var p [2]byte
+	if _, err = io.ReadFull(r, p[:]); err != nil {
+		return
+	}
+	port = strconv.Itoa(int(p[0])<<8 | int(p[1]))
+	// 连接由dispatch建立，按规则判断后再应答
+	return
+}
+
+// 用户名密码认证: VER ULEN UNAME PLEN PASSWD
+func socksAuth(conn net.Conn, r *bufio.Reader) error {
+	ver, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if ver != socksAuthVersion {
+		return ErrSocksVersion
+	}
+	var fields [2][]byte
+	for i := range fields {
+		size, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		fields[i] = make([]byte, size)
+		if _, err = io.ReadFull(r, fields[i]); err != nil {
+			return err
+		}
+	}
+	userOk := subtle.ConstantTimeCompare(fields[0], []byte(config.GoWalk.SocksUser)) == 1
+	passOk := subtle.ConstantTimeCompare(fields[1], []byte(config.GoWalk.SocksPassword)) == 1
+	if !userOk || !passOk {
+		conn.Write([]byte{socksAuthVersion, 1})
+		return ErrSocksAuth
+	}
+	_, err = conn.Write([]byte{socksAuthVersion, 0})
+	return err
+}
+
+func socksReply(conn net.Conn, code byte) error {
+	_, err := conn.Write([]byte{socksVersion, code, 0, socksAtypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+// 客户端发送input，返回握手结果和服务器端写回的全部内容
+func socksExchange(input []byte) (host, port string, output []byte, err error) {
+	server, client := net.Pipe()
+	go client.Write(input)
+	ch := make(chan []byte)
+	go func() {
+		b, _ := ioutil.ReadAll(client)
+		ch <- b
+	}()
+	host, port, err = socksHandshake(server, bufio.NewReader(server))
+	server.Close()
+	output = <-ch
+	client.Close()
+	return
+}
+
+func TestSocksHandshake(t *testing.T) {
+	defer func(user, pass string) {
+		config.GoWalk.SocksUser, config.GoWalk.SocksPassword = user, pass
+	}(config.GoWalk.SocksUser, config.GoWalk.SocksPassword)
+
+	connect := func(atyp byte, addr ...byte) []byte {
+		return append([]byte{5, socksCmdConnect, 0, atyp}, addr...)
+	}
+	domain := append([]byte{14}, "www.google.com"...)
+	auth := func(user, pass string) []byte {
+		b := append([]byte{1, byte(len(user))}, user...)
+		b = append(b, byte(len(pass)))
+		return append(b, pass...)
+	}
+	tests := []struct {
+		name   string
+		user   string
+		input  [][]byte
+		host   string
+		port   string
+		err    error
+		output []byte
+	}{
+		{"ipv4", "", [][]byte{{5, 1, 0}, connect(1, 1, 2, 3, 4, 1, 187)},
+			"1.2.3.4", "443", nil, []byte{5, 0}},
+		{"domain", "", [][]byte{{5, 2, 2, 0}, connect(3, append(domain, 0, 80)...)},
+			"www.google.com", "80", nil, []byte{5, 0}},
+		{"ipv6", "", [][]byte{{5, 1, 0}, connect(4, append(net.ParseIP("2001:db8::1"), 0x1f, 0x90)...)},
+			"2001:db8::1", "8080", nil, []byte{5, 0}},
+		{"version", "", [][]byte{{4, 1, 0}}, "", "", ErrSocksVersion, nil},
+		{"no method", "", [][]byte{{5, 1, 2}}, "", "", ErrSocksAuth, []byte{5, 0xff}},
+		{"password", "u", [][]byte{{5, 2, 0, 2}, auth("u", "p"), connect(1, 1, 2, 3, 4, 0, 80)},
+			"1.2.3.4", "80", nil, []byte{5, 2, 1, 0}},
+		{"wrong password", "u", [][]byte{{5, 1, 2}, auth("u", "x")}, "", "", ErrSocksAuth, []byte{5, 2, 1, 1}},
+		{"password required", "u", [][]byte{{5, 1, 0}}, "", "", ErrSocksAuth, []byte{5, 0xff}},
+		{"bind", "", [][]byte{{5, 1, 0}, {5, 2, 0, 1, 1, 2, 3, 4, 0, 80}}, "", "", ErrSocksCommand,
+			[]byte{5, 0, 5, socksReplyCommandNotSupported, 0, 1, 0, 0, 0, 0, 0, 0}},
+		{"address type", "", [][]byte{{5, 1, 0}, {5, 1, 0, 9}}, "", "", ErrSocksAddr,
+			[]byte{5, 0, 5, socksReplyAddrNotSupported, 0, 1, 0, 0, 0, 0, 0, 0}},
+	}
+	for _, tt := range tests {
+		config.GoWalk.SocksUser, config.GoWalk.SocksPassword = tt.user, "p"
+		host, port, output, err := socksExchange(bytes.Join(tt.input, nil))
+		if err != tt.err || host != tt.host || port != tt.port {
+			t.Errorf("%s: %q %q %v, want %q %q %v", tt.name, host, port, err, tt.host, tt.port, tt.err)
+		}
+		if !bytes.Equal(output, tt.output) {
+			t.Errorf("%s: reply % x, want % x", tt.name, output, tt.output)
+		}
+	}
+}
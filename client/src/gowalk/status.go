@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// 服务器端实例的统计，参考server/stats.go，时间单位为毫秒
+type serverStatus struct {
+	Version  string           `json:"version"`
+	Protocol int              `json:"protocol"`
+	Instance string           `json:"instance"`
+	Start    time.Time        `json:"start"`
+	Uptime   int64            `json:"uptime"`
+	Fetches  int64            `json:"fetches"`
+	Hits     int64            `json:"cache_hits"`
+	Errors   map[string]int64 `json:"errors"`
+	BytesIn  int64            `json:"bytes_in"`
+	BytesOut int64            `json:"bytes_out"`
+	Latency  map[string]int64 `json:"latency"`
+	Hosts    []struct {
+		Host  string `json:"host"`
+		Count int64  `json:"count"`
+	} `json:"hosts"`
+}
+
+// 获取appid的状态，GAE上会返回处理这个请求的实例的统计
+func fetchStatus(appid string) (*serverStatus, error) {
+	var ip = getGoodIp()
+	if ip == "" {
+		return nil, ErrAllIpBad
+	}
+	req, err := http.NewRequest("GET", "https://"+ip+statusPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Host = appid + ".appspot.com"
+	if err = signStatus(req.Header, config.GoWalk.User); err != nil {
+		return nil, err
+	}
+	resp, err := client.Transport.RoundTrip(req)
+	if err != nil {
+		suspCh <- ip
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &ServerError{appid, resp.StatusCode, http.StatusText(resp.StatusCode)}
+	}
+	var status serverStatus
+	if err = json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+type appStatus struct {
+	AppId     string
+	OverQuota bool
+	Status    *serverStatus
+	Err       error
+}
+
+var statusTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>gowalk status</title></head>
+<body>
+<h1>gowalk status</h1>
+{{range .}}
+<h2>{{.AppId}}{{if .OverQuota}} (over quota){{end}}</h2>
+{{if .Err}}
+<p>{{.Err}}</p>
+{{else}}{{with .Status}}
+<table border="1">
+<tr><td>version</td><td>{{.Version}} (protocol {{.Protocol}})</td></tr>
+<tr><td>instance</td><td>{{.Instance}}</td></tr>
+<tr><td>start</td><td>{{.Start}}</td></tr>
+<tr><td>fetches</td><td>{{.Fetches}} ({{.Hits}} cache hits)</td></tr>
+<tr><td>bytes in/out</td><td>{{.BytesIn}} / {{.BytesOut}}</td></tr>
+<tr><td>latency (ms)</td><td>p50 {{.Latency.p50}}, p90 {{.Latency.p90}}, p99 {{.Latency.p99}}</td></tr>
+<tr><td>errors</td><td>{{range $k, $v := .Errors}}{{$k}}: {{$v}}<br>{{end}}</td></tr>
+<tr><td>top hosts</td><td>{{range .Hosts}}{{.Host}}: {{.Count}}<br>{{end}}</td></tr>
+</table>
+{{end}}{{end}}
+{{end}}
+</body>
+</html>
+`))
+
+// 管理页面，显示每个appid的状态
+func statusPage(w http.ResponseWriter) {
+	appids := config.GoWalk.AppId
+	result := make([]appStatus, len(appids))
+	now := time.Now()
+	var wg sync.WaitGroup
+	for i, appid := range appids {
+		quotaLock.Lock()
+		t, ok := overQuota[appid]
+		quotaLock.Unlock()
+		result[i] = appStatus{AppId: appid, OverQuota: ok && now.Before(t)}
+		wg.Add(1)
+		go func(i int, appid string) {
+			defer wg.Done()
+			result[i].Status, result[i].Err = fetchStatus(appid)
+		}(i, appid)
+	}
+	wg.Wait()
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := statusTemplate.Execute(w, result); err != nil {
+		log.Println("Render status page failed:", err)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bufio"
+	"log"
+	"net"
+	"time"
+)
+
+/*
+透明代理，配合iptables把网关转发的连接重定向到transparent_listen
+iptables -t nat -A PREROUTING -p tcp -m multiport --dports 80,443 -j REDIRECT --to-ports 18088
+通过SO_ORIGINAL_DST得到原来的目标地址，TLS用SNI作为域名，HTTP用Host头
+之后和CONNECT一样由dispatch分发
+*/
+func (h *handler) serveTransparent(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if e, ok := err.(net.Error); ok && e.Temporary() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go h.onTransparent(conn)
+	}
+}
+
+func (h *handler) onTransparent(conn net.Conn) {
+	addr, err := originalDst(conn)
+	if err != nil {
+		log.Println("Get original destination failed:", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	log.Println("TRANSPARENT:", conn.RemoteAddr(), "->", addr)
+	h.dispatch(conn, bufio.NewReaderSize(conn, tunnelBufferSize), host, port)
+}
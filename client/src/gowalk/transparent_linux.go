@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"syscall"
+)
+
+const (
+	// linux/netfilter_ipv4.h
+	soOriginalDst = 80
+)
+
+var (
+	ErrNotTCP = errors.New("not a tcp connection")
+)
+
+// 通过SO_ORIGINAL_DST得到iptables重定向之前的目标地址，只支持IPv4
+func originalDst(conn net.Conn) (string, error) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return "", ErrNotTCP
+	}
+	f, err := tc.File()
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	fd := int(f.Fd())
+	// File()会把连接设置为阻塞模式，需要恢复
+	defer syscall.SetNonblock(fd, true)
+	// 返回的是sockaddr_in，借用IPv6Mreq的结构读取
+	// Multiaddr[2:4]为端口，[4:8]为IP地址
+	mreq, err := syscall.GetsockoptIPv6Mreq(fd, syscall.IPPROTO_IP, soOriginalDst)
+	if err != nil {
+		return "", err
+	}
+	addr := mreq.Multiaddr
+	ip := net.IPv4(addr[4], addr[5], addr[6], addr[7])
+	port := int(addr[2])<<8 | int(addr[3])
+	return net.JoinHostPort(ip.String(), strconv.Itoa(port)), nil
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+var (
+	ErrTransparent = errors.New("transparent proxy is only supported on linux")
+)
+
+func originalDst(conn net.Conn) (string, error) {
+	return "", ErrTransparent
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// 隧道连接的读缓冲，可以放下一个完整的TLS记录，用于读取SNI
+	tunnelBufferSize = tlsRecordHeaderLen + 16*1024
+	// 等待客户端发送第一个字节的时间，超时认为是服务器先发送的协议，直连
+	peekTimeout = time.Second
+	// 直连的超时时间
+	directDialTimeout = 10 * time.Second
+)
+
+// 已经读取了一部分内容的连接，先读bufio里面的内容
+type peekConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// 明文HTTP连接的Listener，CONNECT和SOCKS5里面的HTTP请求由plainHandler处理
+type plainListener struct {
+	ch chan net.Conn
+}
+
+var plainConns = &plainListener{make(chan net.Conn, 10)}
+
+func (l *plainListener) Accept() (net.Conn, error) {
+	return <-l.ch, nil
+}
+
+func (l *plainListener) Close() error {
+	return nil
+}
+
+func (l *plainListener) Addr() net.Addr {
+	return nil
+}
+
+// 隧道里面的请求只有路径，补全为http的绝对地址后按普通代理处理
+type plainHandler struct {
+	h *handler
+}
+
+func (p plainHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r.URL.Scheme = "http"
+	r.URL.Host = r.Host
+	p.h.ServeHTTP(w, r)
+}
+
+// 在两个连接之间转发数据，一边结束时关闭两个连接
+func pipe(c1, c2 net.Conn) {
+	defer func() {
+		c1.Close()
+		c2.Close()
+	}()
+	buf := make([]byte, 1024*32)
+	for {
+		n, err := c1.Read(buf)
+		if err != nil {
+			if !strings.HasSuffix(err.Error(), "use of closed network connection") && err != io.EOF {
+				log.Println("Tunnel read failed:", err)
+			}
+			return
+		}
+		n, err = c2.Write(buf[0:n])
+		if err != nil {
+			if !strings.HasSuffix(err.Error(), "use of closed network connection") && err != io.EOF {
+				log.Println("Tunnel write failed:", err)
+			}
+			return
+		}
+	}
+}
+
+func tunnel(conn net.Conn, addr string, dial dialFunc) {
+	peer, err := dial("tcp", addr)
+	if err != nil {
+		log.Println("Tunnel dial failed:", addr, err)
+		conn.Close()
+		return
+	}
+	go pipe(peer, conn)
+	go pipe(conn, peer)
+}
+
+// 按规则转发不经过GAE的连接，gae规则在这里表示直接连接
+func tunnelRule(conn net.Conn, rule *rule, host string, port string) {
+	switch rule.action {
+	case actionBypass:
+		log.Println("BYPASS:", host, port)
+		var ip = getGoodIp()
+		if ip == "" {
+			log.Println("All IP bad")
+			conn.Close()
+			return
+		}
+		// 配置的ip可能带了端口，比如独立服务器的 1.2.3.4:443，按连接的端口重新拼接
+		if h, _, err := net.SplitHostPort(ip); err == nil {
+			ip = h
+		}
+		tunnel(conn, net.JoinHostPort(ip, port), upstreamDial)
+	case actionBlock, actionReject:
+		log.Println("BLOCK:", host, port, rule)
+		conn.Close()
+	case actionProxy:
+		log.Println("PROXY:", host, port, rule.proxyAddr)
+		tunnel(conn, net.JoinHostPort(host, port), rule.dial)
+	default:
+		log.Println("DIRECT:", host, port)
+		tunnel(conn, net.JoinHostPort(host, port), dialDirect)
+	}
+}
+
+/*
+CONNECT、SOCKS5和透明代理建立的连接都从这里分发
+根据客户端发送的第一个字节判断
+0x16为TLS握手，有SNI时用SNI作为域名，按规则转发，走GAE的通过Accept完成SSL握手
+字母为HTTP请求，除了direct和proxy规则直接转发以外，交给plainHandler按每个请求的规则处理
+其他协议或者客户端不先发送的协议按规则转发，不能走GAE
+*/
+func (h *handler) dispatch(conn net.Conn, r *bufio.Reader, host string, port string) {
+	conn.SetReadDeadline(time.Now().Add(peekTimeout))
+	b, err := r.Peek(1)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		if e, ok := err.(net.Error); !ok || !e.Timeout() {
+			conn.Close()
+			return
+		}
+		tunnelRule(&peekConn{conn, r}, streamRule(host, port), host, port)
+		return
+	}
+	switch {
+	case b[0] == tlsRecordHandshake:
+		if sni, err := peekSNI(r); err == nil {
+			host = sni
+		}
+		rule := connRule(host, port)
+		if rule == nil || rule.action == actionGAE {
+			// 通过channel发送到handle.Accept()里面
+			h.ch <- &httpsReq{&peekConn{conn, r}, host}
+			return
+		}
+		tunnelRule(&peekConn{conn, r}, rule, host, port)
+	case b[0] >= 'A' && b[0] <= 'Z':
+		rule := connRule(host, port)
+		if rule != nil && (rule.action == actionDirect || rule.action == actionProxy) {
+			tunnelRule(&peekConn{conn, r}, rule, host, port)
+			return
+		}
+		plainConns.ch <- &peekConn{conn, r}
+	default:
+		tunnelRule(&peekConn{conn, r}, streamRule(host, port), host, port)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// 目标网站的访问策略，在获取之前检查，参考config.go
+type Policy struct {
+	// 允许的scheme，为空时不限制
+	Schemes []string
+	// 允许的method，为空时不限制
+	Methods []string
+	// 允许的端口，为空时不限制
+	Ports []int
+	// 拒绝回环、私有、链路本地和云主机元数据等内部地址
+	DenyPrivate bool
+	// 拒绝的地址段，比如 "203.0.113.0/24"
+	DenyNets []string
+	// 域名模式，可以使用通配符，比如 "*.example.com"
+	// Allow不为空时只允许匹配的域名，Deny优先于Allow
+	Allow []string
+	Deny  []string
+}
+
+// 请求被访问策略拒绝
+type DeniedError struct {
+	Reason string
+}
+
+func (e *DeniedError) Error() string {
+	return "denied by policy: " + e.Reason
+}
+
+// 内部地址，DenyPrivate时拒绝
+var privateNets = parseNets([]string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+})
+
+// 指向本机或者元数据服务的域名，DenyPrivate时拒绝
+var privateHosts = []string{
+	"localhost",
+	"*.localhost",
+	"metadata",
+	"metadata.google.internal",
+	"*.internal",
+}
+
+func parseNets(nets []string) []*net.IPNet {
+	var result []*net.IPNet
+	for _, s := range nets {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			panic(err)
+		}
+		result = append(result, n)
+	}
+	return result
+}
+
+var denyNets = parseNets(policy.DenyNets)
+
+func matchHost(patterns []string, host string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(strings.ToLower(p), host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Policy) checkIP(ip net.IP) error {
+	if p.DenyPrivate {
+		for _, n := range privateNets {
+			if n.Contains(ip) {
+				return &DeniedError{"private address " + ip.String()}
+			}
+		}
+	}
+	for _, n := range denyNets {
+		if n.Contains(ip) {
+			return &DeniedError{"address " + ip.String()}
+		}
+	}
+	return nil
+}
+
+// 检查请求的scheme, method, 端口和目标地址
+// 这里只检查域名和IP形式的地址，独立运行时域名解析出的地址在连接时检查，参考fetch_standalone.go的dialChecked
+// GAE上由urlfetch解析和连接，没有检查解析出的地址，解析到内部地址的公网域名不在这里的保护范围内
+func (p *Policy) check(method string, scheme string, hostport string) error {
+	if len(p.Schemes) > 0 && !contains(p.Schemes, scheme) {
+		return &DeniedError{"scheme " + scheme}
+	}
+	if len(p.Methods) > 0 && !contains(p.Methods, method) {
+		return &DeniedError{"method " + method}
+	}
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = hostport
+		port = "80"
+		if scheme == "https" {
+			port = "443"
+		}
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "" {
+		return &DeniedError{"empty host"}
+	}
+	if len(p.Ports) > 0 {
+		n, err := strconv.Atoi(port)
+		if err != nil {
+			return &DeniedError{"port " + port}
+		}
+		allowed := false
+		for _, v := range p.Ports {
+			if v == n {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return &DeniedError{fmt.Sprintf("port %d", n)}
+		}
+	}
+	if matchHost(p.Deny, host) {
+		return &DeniedError{"host " + host}
+	}
+	if len(p.Allow) > 0 && !matchHost(p.Allow, host) {
+		return &DeniedError{"host " + host + " not allowed"}
+	}
+	if p.DenyPrivate && matchHost(privateHosts, host) {
+		return &DeniedError{"private host " + host}
+	}
+	if ip := net.ParseIP(strings.Trim(host, "[]")); ip != nil {
+		return p.checkIP(ip)
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestPolicyCheck(t *testing.T) {
+	defer func(n []*net.IPNet) { denyNets = n }(denyNets)
+	denyNets = parseNets([]string{"203.0.113.0/24"})
+	p := &Policy{
+		Schemes:     []string{"http", "https"},
+		Methods:     []string{"GET", "POST"},
+		Ports:       []int{80, 443, 8080},
+		DenyPrivate: true,
+		Deny:        []string{"*.blocked.com"},
+	}
+	allow := &Policy{Allow: []string{"*.example.com", "example.com"}}
+	tests := []struct {
+		policy *Policy
+		method string
+		scheme string
+		host   string
+		ok     bool
+	}{
+		{p, "GET", "http", "www.google.com", true},
+		{p, "POST", "https", "www.google.com:443", true},
+		{p, "GET", "http", "www.google.com:8080", true},
+		{p, "GET", "ftp", "www.google.com", false},
+		{p, "DELETE", "http", "www.google.com", false},
+		{p, "GET", "http", "www.google.com:22", false},
+		{p, "GET", "https", "www.google.com:x", false},
+		{p, "GET", "http", "", false},
+		{p, "GET", "http", "a.blocked.com", false},
+		{p, "GET", "http", "A.Blocked.COM.", false},
+		{p, "GET", "http", "blocked.com", true},
+		{p, "GET", "http", "localhost", false},
+		{p, "GET", "http", "x.localhost:8080", false},
+		{p, "GET", "http", "metadata.google.internal", false},
+		{p, "GET", "http", "127.0.0.1", false},
+		{p, "GET", "http", "10.1.2.3:8080", false},
+		{p, "GET", "http", "172.31.0.1", false},
+		{p, "GET", "http", "192.168.1.1", false},
+		{p, "GET", "http", "169.254.169.254", false},
+		{p, "GET", "http", "[::1]:80", false},
+		{p, "GET", "http", "[fe80::1]", false},
+		{p, "GET", "http", "[fd00::1]:443", false},
+		{p, "GET", "http", "8.8.8.8", true},
+		{p, "GET", "http", "[2001:4860:4860::8888]", true},
+		{p, "GET", "http", "203.0.113.5", false},
+		{&Policy{}, "GET", "http", "127.0.0.1", true},
+		{&Policy{}, "GET", "http", "203.0.113.5", false},
+		{allow, "GET", "http", "example.com", true},
+		{allow, "GET", "http", "www.example.com", true},
+		{allow, "GET", "http", "example.org", false},
+		{allow, "GET", "http", "www.example.com.evil.org", false},
+	}
+	for _, tt := range tests {
+		err := tt.policy.check(tt.method, tt.scheme, tt.host)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s %s://%s: %v", tt.method, tt.scheme, tt.host, err)
+		}
+		if _, denied := err.(*DeniedError); err != nil && !denied {
+			t.Errorf("%s %s://%s: %T, want *DeniedError", tt.method, tt.scheme, tt.host, err)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// 缓存的最大应答长度，memcache的item不能超过1M
+	maxCacheSize = 1000 * 1024
+	// 有ETag的应答过期之后继续保留的时间，用于向目标网站验证
+	cacheRevalidateKeep = 24 * time.Hour
+)
+
+// 缓存的应答
+// 每个URL只保存一个版本，Vary的头部不一致时当作没有缓存，获取后替换原来的版本
+type cacheEntry struct {
+	Status  int
+	Header  http.Header
+	Body    []byte
+	Vary    map[string]string
+	Stored  time.Time
+	Expires time.Time
+}
+
+// 缓存的key包括URL和Range，客户端自动分块时Range是固定的
+func cacheKey(req *http.Request) string {
+	h := sha256.New()
+	h.Write([]byte(req.URL.String()))
+	h.Write([]byte{0})
+	h.Write([]byte(req.Header.Get("Range")))
+	return "cache:" + hex.EncodeToString(h.Sum(nil))
+}
+
+func (e *cacheEntry) matchVary(req *http.Request) bool {
+	return matchVary(e.Vary, req)
+}
+
+func (e *cacheEntry) response(req *http.Request, now time.Time) *http.Response {
+	header := make(http.Header)
+	for k, v := range e.Header {
+		header[k] = v
+	}
+	age := int64(now.Sub(e.Stored) / time.Second)
+	if v, err := strconv.ParseInt(header.Get("Age"), 10, 64); err == nil {
+		age += v
+	}
+	header.Set("Age", strconv.FormatInt(age, 10))
+	etag := e.Header.Get("ETag")
+	if etag != "" && req.Header.Get("If-None-Match") == etag {
+		// 浏览器已经有相同的内容
+		header.Del("Content-Length")
+		return &http.Response{
+			StatusCode: http.StatusNotModified,
+			Header:     header,
+			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		}
+	}
+	return &http.Response{
+		StatusCode:    e.Status,
+		Header:        header,
+		ContentLength: int64(len(e.Body)),
+		Body:          ioutil.NopCloser(bytes.NewReader(e.Body)),
+	}
+}
+
+// 缓存由所有用户共享，请求带有Cookie时应答可能是这个用户私有的
+// 这时只有明确为public或者有s-maxage的应答才能存入缓存或者从缓存返回
+func shareable(req *http.Request, h http.Header) bool {
+	if req.Header.Get("Cookie") == "" {
+		return true
+	}
+	cc := parseCacheControl(h)
+	_, public := cc["public"]
+	_, smaxage := cc["s-maxage"]
+	return public || smaxage
+}
+
+func loadCache(f Fetcher, key string) *cacheEntry {
+	value, ok := f.GetCache(key)
+	if !ok {
+		return nil
+	}
+	var e cacheEntry
+	if err := gob.NewDecoder(bytes.NewReader(value)).Decode(&e); err != nil {
+		f.Warningf("Decode cache failed: %v", err)
+		return nil
+	}
+	return &e
+}
+
+func storeCache(f Fetcher, key string, e *cacheEntry) {
+	var buff bytes.Buffer
+	if err := gob.NewEncoder(&buff).Encode(e); err != nil {
+		f.Warningf("Encode cache failed: %v", err)
+		return
+	}
+	expire := e.Expires.Sub(e.Stored)
+	if e.Header.Get("ETag") != "" {
+		expire += cacheRevalidateKeep
+	}
+	if expire <= 0 || buff.Len() > maxCacheSize+64*1024 {
+		return
+	}
+	f.SetCache(key, buff.Bytes(), expire)
+}
+
+// 先从缓存获取，没有缓存或者过期时通过origin获取，可以缓存的应答同时存入缓存
+// 过期的应答有ETag时带上If-None-Match向目标网站验证，返回304时继续使用缓存
+// 返回的hit表示应答来自缓存
+func fetchCached(f Fetcher, req *http.Request, origin func(*http.Request) (*http.Response, error)) (*http.Response, bool, error) {
+	now := time.Now()
+	key := cacheKey(req)
+	entry := loadCache(f, key)
+	if entry != nil && (!entry.matchVary(req) || !shareable(req, entry.Header)) {
+		entry = nil
+	}
+	if entry != nil && now.Before(entry.Expires) && !mustRevalidate(req) {
+		stats.addCacheHit()
+		return entry.response(req, now), true, nil
+	}
+
+	originReq := req
+	etag := ""
+	if entry != nil {
+		etag = entry.Header.Get("ETag")
+	}
+	if etag != "" {
+		originReq = new(http.Request)
+		*originReq = *req
+		originReq.Header = make(http.Header)
+		for k, v := range req.Header {
+			originReq.Header[k] = v
+		}
+		originReq.Header.Del("If-Modified-Since")
+		originReq.Header.Set("If-None-Match", etag)
+	}
+	resp, err := origin(originReq)
+	if err != nil {
+		return nil, false, err
+	}
+	if etag != "" && resp.StatusCode == http.StatusNotModified {
+		// 内容没有变化，用304的头部更新缓存的头部和有效期，继续使用缓存
+		resp.Body.Close()
+		for k, v := range resp.Header {
+			if k != "Content-Length" {
+				entry.Header[k] = v
+			}
+		}
+		cached := &http.Response{StatusCode: entry.Status, Header: entry.Header, ContentLength: int64(len(entry.Body))}
+		if ttl, ok := freshness(req, cached, now, maxCacheSize); ok {
+			entry.Expires = now.Add(ttl)
+		}
+		entry.Stored = now
+		storeCache(f, key, entry)
+		stats.addCacheHit()
+		return entry.response(req, now), true, nil
+	}
+	ttl, ok := freshness(req, resp, now, maxCacheSize)
+	if !ok || (ttl <= 0 && resp.Header.Get("ETag") == "") || !shareable(req, resp.Header) {
+		return resp, false, nil
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, false, err
+	}
+	entry = &cacheEntry{
+		Status:  resp.StatusCode,
+		Header:  resp.Header,
+		Body:    body,
+		Vary:    varyValues(req, resp),
+		Stored:  now,
+		Expires: now.Add(ttl),
+	}
+	storeCache(f, key, entry)
+	resp.ContentLength = int64(len(body))
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return resp, false, nil
+}
@@ -0,0 +1,74 @@
+//go:build !appengine
+// +build !appengine
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// 内存缓存的总大小
+	memCacheSize = 64 * 1024 * 1024
+)
+
+// 独立运行时的应答缓存，代替memcache，超过总大小时先淘汰过期的，再随机淘汰
+type memStore struct {
+	lock  sync.Mutex
+	items map[string]memItem
+	size  int
+}
+
+type memItem struct {
+	value  []byte
+	expire time.Time
+}
+
+var memCache = &memStore{items: make(map[string]memItem)}
+
+func (s *memStore) get(key string) ([]byte, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	item, ok := s.items[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(item.expire) {
+		s.remove(key)
+		return nil, false
+	}
+	return item.value, true
+}
+
+func (s *memStore) set(key string, value []byte, expire time.Duration) {
+	if len(value) > memCacheSize/16 {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.remove(key)
+	if s.size+len(value) > memCacheSize {
+		now := time.Now()
+		for k, item := range s.items {
+			if now.After(item.expire) {
+				s.remove(k)
+			}
+		}
+		for k := range s.items {
+			if s.size+len(value) <= memCacheSize {
+				break
+			}
+			s.remove(k)
+		}
+	}
+	s.items[key] = memItem{value, time.Now().Add(expire)}
+	s.size += len(value)
+}
+
+func (s *memStore) remove(key string) {
+	if item, ok := s.items[key]; ok {
+		s.size -= len(item.value)
+		delete(s.items, key)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestFetchCachedCookie(t *testing.T) {
+	f := newFetcher(httptest.NewRequest("POST", "/", nil))
+	tests := []struct {
+		name  string
+		cc    string
+		store string
+		fetch string
+		hit   bool
+	}{
+		{"public", "max-age=60", "", "", true},
+		{"cookie stored", "max-age=60", "a=1", "", false},
+		{"cookie served", "max-age=60", "", "a=1", false},
+		{"cookie public", "public, max-age=60", "a=1", "b=2", true},
+		{"cookie s-maxage", "s-maxage=60", "a=1", "a=1", true},
+	}
+	for i, tt := range tests {
+		url := "http://www.example.com/cookie/" + strconv.Itoa(i)
+		calls := 0
+		origin := func(req *http.Request) (*http.Response, error) {
+			calls++
+			body := "user " + req.Header.Get("Cookie")
+			return &http.Response{
+				StatusCode:    200,
+				Header:        http.Header{"Cache-Control": {tt.cc}},
+				ContentLength: int64(len(body)),
+				Body:          ioutil.NopCloser(bytes.NewReader([]byte(body))),
+			}, nil
+		}
+		for _, cookie := range []string{tt.store, tt.fetch} {
+			req, _ := http.NewRequest("GET", url, nil)
+			if cookie != "" {
+				req.Header.Set("Cookie", cookie)
+			}
+			resp, _, err := fetchCached(f, req, origin)
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			resp.Body.Close()
+		}
+		if hit := calls == 1; hit != tt.hit {
+			t.Errorf("%s: %d origin fetches, hit %v, want %v", tt.name, calls, hit, tt.hit)
+		}
+	}
+}
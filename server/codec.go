@@ -2,103 +2,448 @@ package main
 
 import (
 	"bufio"
-	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
 	"errors"
+	"fmt"
+	"hash"
 	"io"
 	"net/http"
-	"strconv"
-	"strings"
 )
 
 var (
 	// 格式错误
 	ErrFormat = errors.New("format")
+	// body的摘要不一致
+	ErrDigest = errors.New("digest")
 )
 
+// 对端的协议版本和本地不一致
+type VersionError struct {
+	Version byte
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("protocol version %d, want %d", e.Version, protocolVersion)
+}
+
 type HttpData struct {
-	Method   string
-	Url      string
-	Password string
-	Status   int
-	Header   http.Header
-	Body     io.ReadCloser
+	// 用户名，不加密，服务器端根据用户名选择密钥和配额
+	User   string
+	Method string
+	Url    string
+	Status int
+	Header http.Header
+	Body   io.ReadCloser
+
+	// 请求签名，参考signRequest
+	Timestamp int64
+	Nonce     string
+	Signature string
+
+	// 压缩策略，请求里面带给服务器端，服务器端按照这个策略压缩应答
+	CompressMinSize int
+	CompressLevel   int
+
+	// 服务器端获取失败时返回错误类型和错误信息，不带status和body
+	Error    ErrorCode
+	ErrorMsg string
+
+	// 请求里面的Range是客户端自动添加的，目标网站不支持时服务器端可以去掉
+	AutoRange bool
+	// body的sha256，不为空时解码body的同时校验
+	Digest string
+	// 服务器端把请求的Range分成多段并发获取，按顺序返回，0或1为不分段
+	Parallel int
+	// 应答来自服务器端的缓存
+	CacheHit bool
 }
 
+// 服务器端获取失败的错误类型，客户端根据类型决定如何处理
+type ErrorCode int
+
 const (
-	X_GW_Method = "X-GW-METHOD"
-	X_GW_URL    = "X-GW-URL"
-	X_GW_Status = "X-GW-STATUS"
-	X_GW_PWD    = "X-GW-PWD"
+	ErrorNone ErrorCode = iota
+	// 获取超时
+	ErrorDeadline
+	// 应答超过了urlfetch的限制
+	ErrorTooLarge
+	// GAE配额用完
+	ErrorOverQuota
+	// 错误的URL
+	ErrorInvalidUrl
+	// 目标网站的证书校验失败
+	ErrorSSL
+	// 签名校验失败或者重放的请求
+	ErrorUnauthorized
+	// 其他获取失败
+	ErrorFetch
+	// 用户超出了每日的配额
+	ErrorQuotaExceeded
+	// 用户不允许访问这个域名
+	ErrorForbidden
+	// 服务器端的访问策略拒绝了这个请求
+	ErrorDenied
 )
 
-func encode(data *HttpData, w io.Writer) (err error) {
-	zw := gzip.NewWriter(w)
-	if data.Method != "" {
-		zw.Write([]byte(X_GW_Method))
-		zw.Write([]byte{':'})
-		zw.Write([]byte(data.Method))
-		zw.Write([]byte{'\n'})
-	}
-	if data.Url != "" {
-		zw.Write([]byte(X_GW_URL))
-		zw.Write([]byte{':'})
-		zw.Write([]byte(data.Url))
-		zw.Write([]byte{'\n'})
-	}
-	if data.Password != "" {
-		zw.Write([]byte(X_GW_PWD))
-		zw.Write([]byte{':'})
-		zw.Write([]byte(data.Password))
-		zw.Write([]byte{'\n'})
-	}
-	if data.Status != 0 {
-		zw.Write([]byte(X_GW_Status))
-		zw.Write([]byte{':'})
-		zw.Write([]byte(strconv.FormatInt(int64(data.Status), 10)))
-		zw.Write([]byte{'\n'})
+var errorNames = []string{
+	"none",
+	"deadline exceeded",
+	"response too large",
+	"over quota",
+	"invalid url",
+	"ssl certificate error",
+	"unauthorized",
+	"fetch failed",
+	"quota exceeded",
+	"forbidden",
+	"denied",
+}
+
+func (c ErrorCode) String() string {
+	if c < 0 || int(c) >= len(errorNames) {
+		return fmt.Sprintf("error %d", int(c))
+	}
+	return errorNames[c]
+}
+
+/*
+帧格式
+magic(2字节"GW") + protocolVersion(1字节) + flags(1字节)，不压缩
+flags带有flagUser时，之后为 uvarint长度 + 用户名，不加密
+flags带有flagSealed时，之后的内容用secretbox加密，参考sealWriter
+加密层里面为按照flagGzip/flagDeflate压缩的内容，两个都没有表示不压缩:
+
+	字段: type(1字节) + 内容，以fieldEnd结束
+		字符串字段: uvarint长度 + 内容
+		status, timestamp, compressMinSize, compressLevel, error, autoRange, parallel, cacheHit: uvarint
+		header: uvarint长度 + key + uvarint长度 + value
+	body: 若干个 uvarint长度 + 内容 的分块，以长度为0的分块结束
+*/
+const (
+	frameMagic = "GW"
+	// 协议版本，帧格式或者字段含义不兼容时增加
+	protocolVersion = 11
+
+	// 单个字段的最大长度，防止错误数据导致分配过大的内存
+	maxFieldSize = 1024 * 1024
+	// body单个分块的最大长度
+	maxChunkSize = 64 * 1024
+	// 用户名的最大长度
+	maxUserSize = 64
+)
+
+const (
+	flagSealed byte = 1 << iota
+	flagGzip
+	flagDeflate
+	flagUser
+
+	flagCompression = flagGzip | flagDeflate
+	flagAll         = flagSealed | flagCompression | flagUser
+)
+
+const (
+	fieldEnd byte = iota
+	fieldMethod
+	fieldUrl
+	fieldStatus
+	fieldHeader
+	fieldTimestamp
+	fieldNonce
+	fieldSignature
+	fieldCompressMinSize
+	fieldCompressLevel
+	fieldError
+	fieldErrorMsg
+	fieldAutoRange
+	fieldDigest
+	fieldParallel
+	fieldCacheHit
+)
+
+// 写入出错后，后续写入都忽略，只需在最后检查一次err
+type frameWriter struct {
+	w   io.Writer
+	err error
+	buf [binary.MaxVarintLen64]byte
+}
+
+func (fw *frameWriter) write(p []byte) {
+	if fw.err != nil {
+		return
+	}
+	_, fw.err = fw.w.Write(p)
+}
+
+func (fw *frameWriter) writeByte(b byte) {
+	fw.buf[0] = b
+	fw.write(fw.buf[:1])
+}
+
+func (fw *frameWriter) writeUvarint(v uint64) {
+	n := binary.PutUvarint(fw.buf[:], v)
+	fw.write(fw.buf[:n])
+}
+
+func (fw *frameWriter) writeString(s string) {
+	fw.writeUvarint(uint64(len(s)))
+	fw.write([]byte(s))
+}
+
+func (fw *frameWriter) writeField(t byte, s string) {
+	if s == "" {
+		return
+	}
+	fw.writeByte(t)
+	fw.writeString(s)
+}
+
+func (fw *frameWriter) writeUint(t byte, v int) {
+	if v <= 0 {
+		return
+	}
+	fw.writeByte(t)
+	fw.writeUvarint(uint64(v))
+}
+
+func encode(data *HttpData, w io.Writer, cn <-chan bool) (err error) {
+	if len(data.User) > maxUserSize {
+		return ErrFormat
+	}
+	key, _, err := userKeys(data.User)
+	if err != nil {
+		return err
+	}
+	compression := chooseCompression(data, key != nil)
+	flags := compression
+	if key != nil {
+		flags |= flagSealed
+	}
+	if data.User != "" {
+		flags |= flagUser
+	}
+	hw := &frameWriter{w: w}
+	hw.write([]byte{frameMagic[0], frameMagic[1], protocolVersion, flags})
+	if data.User != "" {
+		hw.writeString(data.User)
+	}
+	if hw.err != nil {
+		return hw.err
+	}
+	var sw *sealWriter
+	if key != nil {
+		sw, err = newSealWriter(w, key)
+		if err != nil {
+			return err
+		}
+		w = sw
+	}
+	zw, err := newCompressWriter(w, compression, data.CompressLevel)
+	if err != nil {
+		return err
+	}
+	fw := &frameWriter{w: zw}
+	fw.writeField(fieldMethod, data.Method)
+	fw.writeField(fieldUrl, data.Url)
+	fw.writeUint(fieldStatus, data.Status)
+	if data.Timestamp != 0 {
+		fw.writeByte(fieldTimestamp)
+		fw.writeUvarint(uint64(data.Timestamp))
+	}
+	fw.writeField(fieldNonce, data.Nonce)
+	fw.writeField(fieldSignature, data.Signature)
+	fw.writeUint(fieldCompressMinSize, data.CompressMinSize)
+	fw.writeUint(fieldCompressLevel, data.CompressLevel)
+	fw.writeUint(fieldError, int(data.Error))
+	fw.writeField(fieldErrorMsg, data.ErrorMsg)
+	if data.AutoRange {
+		fw.writeUint(fieldAutoRange, 1)
+	}
+	fw.writeField(fieldDigest, data.Digest)
+	fw.writeUint(fieldParallel, data.Parallel)
+	if data.CacheHit {
+		fw.writeUint(fieldCacheHit, 1)
 	}
 	for k, i := range data.Header {
 		for _, v := range i {
-			zw.Write([]byte(k))
-			zw.Write([]byte{':'})
-			zw.Write([]byte(v))
-			zw.Write([]byte{'\n'})
+			fw.writeByte(fieldHeader)
+			fw.writeString(k)
+			fw.writeString(v)
 		}
 	}
-	zw.Write([]byte{'\n'})
-	buf := make([]byte, 8*1024)
-	for {
-		buf = buf[:cap(buf)]
-		n, err := data.Body.Read(buf)
-		if n != 0 {
-			zw.Write(buf[:n])
-		}
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return err
+	fw.writeByte(fieldEnd)
+	if fw.err != nil {
+		return fw.err
+	}
+	if data.Body != nil {
+		buf := make([]byte, 8*1024)
+		for {
+			select {
+			case <-cn:
+				return io.EOF
+			default:
+			}
+			n, err := data.Body.Read(buf)
+			if n != 0 {
+				fw.writeUvarint(uint64(n))
+				fw.write(buf[:n])
+				if fw.err != nil {
+					return fw.err
+				}
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
 		}
 	}
+	// body结束标记
+	fw.writeUvarint(0)
+	if fw.err != nil {
+		return fw.err
+	}
 	err = zw.Close()
+	if err == nil && sw != nil {
+		err = sw.Close()
+	}
 	return
 }
 
-type BufGzipReader struct {
-	r *bufio.Reader
-	z *gzip.Reader
+// 读取分块的body，读到结束标记并且帧也结束后返回io.EOF
+// 有digest时同时计算摘要，结束时不一致返回ErrDigest
+type ChunkReader struct {
+	r      *bufio.Reader
+	z      io.Closer
+	left   uint64
+	eof    bool
+	hash   hash.Hash
+	digest string
 }
 
-func (r *BufGzipReader) Close() error {
+func (r *ChunkReader) Close() error {
 	return r.z.Close()
 }
 
-func (r *BufGzipReader) Read(p []byte) (n int, err error) {
-	return r.r.Read(p)
+func (r *ChunkReader) Read(p []byte) (n int, err error) {
+	if r.eof {
+		return 0, io.EOF
+	}
+	if r.left == 0 {
+		r.left, err = binary.ReadUvarint(r.r)
+		if err != nil {
+			return 0, unexpected(err)
+		}
+		if r.left == 0 {
+			r.eof = true
+			// 结束标记之后不应该还有内容，压缩时同时校验了gzip的结尾
+			if _, err = r.r.ReadByte(); err != io.EOF {
+				if err == nil {
+					err = ErrFormat
+				}
+				return 0, err
+			}
+			if r.hash != nil && string(r.hash.Sum(nil)) != r.digest {
+				return 0, ErrDigest
+			}
+			return 0, io.EOF
+		}
+		if r.left > maxChunkSize {
+			return 0, ErrFormat
+		}
+	}
+	if uint64(len(p)) > r.left {
+		p = p[:r.left]
+	}
+	n, err = r.r.Read(p)
+	r.left -= uint64(n)
+	if r.hash != nil {
+		r.hash.Write(p[:n])
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return
+}
+
+// 帧在结束标记之前结束的都是不完整的帧
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func readString(r *bufio.Reader) (string, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", unexpected(err)
+	}
+	if size > maxFieldSize {
+		return "", ErrFormat
+	}
+	buf := make([]byte, size)
+	_, err = io.ReadFull(r, buf)
+	if err != nil {
+		return "", unexpected(err)
+	}
+	return string(buf), nil
+}
+
+func readInt(r *bufio.Reader) (int, error) {
+	v, err := binary.ReadUvarint(r)
+	if err == nil && v > 1<<31-1 {
+		err = ErrFormat
+	}
+	return int(v), err
 }
 
 func decode(_r io.Reader) (data *HttpData, err error) {
-	zr, err := gzip.NewReader(_r)
+	br := bufio.NewReader(_r)
+	var head [4]byte
+	_, err = io.ReadFull(br, head[:])
+	if err != nil {
+		return nil, unexpected(err)
+	}
+	if string(head[:2]) != frameMagic {
+		return nil, ErrFormat
+	}
+	if head[2] != protocolVersion {
+		return nil, &VersionError{head[2]}
+	}
+	flags := head[3]
+	if flags&^flagAll != 0 || flags&flagCompression == flagCompression {
+		return nil, ErrFormat
+	}
+	var user string
+	if flags&flagUser != 0 {
+		user, err = readString(br)
+		if err != nil {
+			return nil, err
+		}
+		if user == "" || len(user) > maxUserSize {
+			return nil, ErrFormat
+		}
+	}
+	key, _, err := userKeys(user)
+	if err != nil {
+		return nil, err
+	}
+	var in io.Reader = br
+	if flags&flagSealed != 0 {
+		if key == nil {
+			return nil, ErrOpen
+		}
+		in, err = newOpenReader(br, key)
+		if err != nil {
+			return nil, err
+		}
+	} else if key != nil {
+		return nil, ErrUnsealed
+	}
+	zr, err := newDecompressReader(in, flags&flagCompression)
 	if err != nil {
 		return nil, err
 	}
@@ -107,43 +452,177 @@ func decode(_r io.Reader) (data *HttpData, err error) {
 			zr.Close()
 		}
 	}()
-	r := &BufGzipReader{bufio.NewReader(zr), zr}
+	r := bufio.NewReader(zr)
 
-	data = &HttpData{Header: make(http.Header)}
+	data = &HttpData{User: user, Header: make(http.Header)}
 	for {
-		line, err := r.r.ReadString('\n')
+		t, err := r.ReadByte()
 		if err != nil {
-			return nil, err
+			return nil, unexpected(err)
 		}
-		if len(line) == 1 {
-			// 遇到空行,迭代结束
+		if t == fieldEnd {
 			break
 		}
-		kv := strings.SplitN(line, ":", 2)
-		if len(kv) != 2 {
-			return nil, ErrFormat
-		}
-		key := kv[0]
-		value := kv[1][0 : len(kv[1])-1]
-		if key == "" {
-			return nil, ErrFormat
-		} else if key == X_GW_Method {
-			data.Method = value
-		} else if key == X_GW_URL {
-			data.Url = value
-		} else if key == X_GW_PWD {
-			data.Password = value
-		} else if key == X_GW_Status {
-			var code int64
-			code, err = strconv.ParseInt(value, 10, 32)
-			if err != nil {
-				return nil, ErrFormat
+		switch t {
+		case fieldMethod:
+			data.Method, err = readString(r)
+		case fieldUrl:
+			data.Url, err = readString(r)
+		case fieldStatus:
+			var code uint64
+			code, err = binary.ReadUvarint(r)
+			if err == nil && code > 999 {
+				err = ErrFormat
 			}
 			data.Status = int(code)
-		} else {
-			data.Header.Add(key, value)
+		case fieldTimestamp:
+			var ts uint64
+			ts, err = binary.ReadUvarint(r)
+			data.Timestamp = int64(ts)
+		case fieldNonce:
+			data.Nonce, err = readString(r)
+		case fieldSignature:
+			data.Signature, err = readString(r)
+		case fieldCompressMinSize:
+			data.CompressMinSize, err = readInt(r)
+		case fieldCompressLevel:
+			data.CompressLevel, err = readInt(r)
+		case fieldError:
+			var code int
+			code, err = readInt(r)
+			data.Error = ErrorCode(code)
+		case fieldErrorMsg:
+			data.ErrorMsg, err = readString(r)
+		case fieldAutoRange:
+			var v int
+			v, err = readInt(r)
+			data.AutoRange = v != 0
+		case fieldDigest:
+			data.Digest, err = readString(r)
+		case fieldParallel:
+			data.Parallel, err = readInt(r)
+		case fieldCacheHit:
+			var v int
+			v, err = readInt(r)
+			data.CacheHit = v != 0
+		case fieldHeader:
+			var key, value string
+			key, err = readString(r)
+			if err == nil {
+				value, err = readString(r)
+			}
+			if err == nil && key == "" {
+				err = ErrFormat
+			}
+			if err == nil {
+				data.Header.Add(key, value)
+			}
+		default:
+			err = ErrFormat
+		}
+		if err != nil {
+			return nil, unexpected(err)
 		}
 	}
-	data.Body = r
+	body := &ChunkReader{r: r, z: zr}
+	if data.Digest != "" {
+		body.hash = sha256.New()
+		body.digest = data.Digest
+	}
+	data.Body = body
 	return
 }
+
+/*
+批量请求
+magic(2字节"GB") + protocolVersion(1字节) + uvarint数量
+之后每个请求为 uvarint长度 + 帧
+批量应答的头部相同，之后每个应答为 uvarint序号 + uvarint长度 + 帧，按完成的顺序排列
+应答长度为0表示这个请求没有处理，需要单独重新发送
+*/
+const (
+	batchMagic = "GB"
+
+	// 一次批量请求的最大数量
+	maxBatchCount = 64
+	// 批量里面单个帧的最大长度
+	maxBatchFrameSize = 32 * 1024 * 1024
+)
+
+func isBatch(r *bufio.Reader) bool {
+	p, err := r.Peek(len(batchMagic))
+	return err == nil && string(p) == batchMagic
+}
+
+func writeBatchHead(w io.Writer, count int) error {
+	fw := &frameWriter{w: w}
+	fw.write([]byte{batchMagic[0], batchMagic[1], protocolVersion})
+	fw.writeUvarint(uint64(count))
+	return fw.err
+}
+
+func readBatchHead(r *bufio.Reader) (int, error) {
+	var head [3]byte
+	_, err := io.ReadFull(r, head[:])
+	if err != nil {
+		return 0, unexpected(err)
+	}
+	if string(head[:2]) != batchMagic {
+		return 0, ErrFormat
+	}
+	if head[2] != protocolVersion {
+		return 0, &VersionError{head[2]}
+	}
+	count, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, unexpected(err)
+	}
+	if count > maxBatchCount {
+		return 0, ErrFormat
+	}
+	return int(count), nil
+}
+
+func writeBatchFrame(w io.Writer, frame []byte) error {
+	fw := &frameWriter{w: w}
+	fw.writeUvarint(uint64(len(frame)))
+	fw.write(frame)
+	return fw.err
+}
+
+func readBatchFrame(r *bufio.Reader) ([]byte, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, unexpected(err)
+	}
+	if size > maxBatchFrameSize {
+		return nil, ErrFormat
+	}
+	frame := make([]byte, size)
+	_, err = io.ReadFull(r, frame)
+	if err != nil {
+		return nil, unexpected(err)
+	}
+	return frame, nil
+}
+
+func writeBatchReply(w io.Writer, index int, frame []byte) error {
+	fw := &frameWriter{w: w}
+	fw.writeUvarint(uint64(index))
+	if fw.err != nil {
+		return fw.err
+	}
+	return writeBatchFrame(w, frame)
+}
+
+func readBatchReply(r *bufio.Reader, count int) (int, []byte, error) {
+	index, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, nil, unexpected(err)
+	}
+	if index >= uint64(count) {
+		return 0, nil, ErrFormat
+	}
+	frame, err := readBatchFrame(r)
+	return int(index), frame, err
+}
@@ -1,3 +1,33 @@
 package main
 
 const password = ""
+
+// 是否加密传输，需要和客户端配置一致
+const encrypt = false
+
+// 是否缓存公开的GET应答，多个用户访问相同的内容时减少获取，参考cache.go
+const cacheEnabled = false
+
+// 多个用户，每个用户使用自己的密码和配额，客户端在gowalk.conf里面设置user和password
+// 配置了用户之后，不带用户名的请求都会被拒绝，password不再使用
+var users = []User{
+	// {Name: "alice", Password: "secret", DailyBytes: 1 << 30, DailyRequests: 10000, Admin: true},
+	// {Name: "bob", Password: "secret2", Domains: []string{"github.com", "golang.org"}},
+}
+
+// 目标网站的访问策略，参考acl.go
+var policy = Policy{
+	Schemes:     []string{"http", "https"},
+	Methods:     []string{"GET", "HEAD", "POST", "PUT", "DELETE", "OPTIONS", "PATCH"},
+	DenyPrivate: true,
+	// Ports: []int{80, 443},
+	// DenyNets: []string{"203.0.113.0/24"},
+	// Allow: []string{"*.example.com", "example.com"},
+	// Deny: []string{"*.example.org"},
+}
+
+// 隐私规则，获取之前去掉匹配的头部，参考header.go
+var privacyRules = []PrivacyRule{
+	{Headers: []string{"X-Forwarded-For", "Via", "Forwarded"}},
+	// {Domains: []string{".example.com"}, Headers: []string{"Referer"}},
+}
@@ -0,0 +1,93 @@
+//go:build appengine
+// +build appengine
+
+package main
+
+import (
+	"appengine"
+	"appengine/memcache"
+	"appengine/urlfetch"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type gaeFetcher struct {
+	appengine.Context
+	*urlfetch.Transport
+}
+
+func newFetcher(r *http.Request) Fetcher {
+	c := appengine.NewContext(r)
+	return &gaeFetcher{
+		Context:   c,
+		Transport: &urlfetch.Transport{Context: c, Deadline: fetchDeadline},
+	}
+}
+
+// 通过memcache记录nonce，所有实例共享
+func (f *gaeFetcher) AddNonce(nonce string, expire time.Duration) (bool, error) {
+	err := memcache.Add(f.Context, &memcache.Item{
+		Key:        "nonce:" + hex.EncodeToString([]byte(nonce)),
+		Value:      []byte{1},
+		Expiration: expire,
+	})
+	if err == memcache.ErrNotStored {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func instanceID() string {
+	return appengine.InstanceID()
+}
+
+// 用户的用量也记在memcache里面，被清除时重新计数
+func (f *gaeFetcher) AddUsage(key string, delta int64) (int64, error) {
+	v, err := memcache.Increment(f.Context, key, delta, 0)
+	return int64(v), err
+}
+
+func (f *gaeFetcher) GetCache(key string) ([]byte, bool) {
+	item, err := memcache.Get(f.Context, key)
+	if err != nil {
+		if err != memcache.ErrCacheMiss {
+			f.Warningf("Get cache failed: %v", err)
+		}
+		return nil, false
+	}
+	return item.Value, true
+}
+
+func (f *gaeFetcher) SetCache(key string, value []byte, expire time.Duration) {
+	err := memcache.Set(f.Context, &memcache.Item{
+		Key:        key,
+		Value:      value,
+		Expiration: expire,
+	})
+	if err != nil {
+		f.Warningf("Set cache failed: %v", err)
+	}
+}
+
+// 根据urlfetch的错误信息判断错误类型
+func (f *gaeFetcher) ErrorCode(err error) ErrorCode {
+	if appengine.IsOverQuota(err) {
+		return ErrorOverQuota
+	}
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "DEADLINE_EXCEEDED"), strings.Contains(msg, "timeout"):
+		return ErrorDeadline
+	case strings.Contains(msg, "RESPONSE_TOO_LARGE"):
+		return ErrorTooLarge
+	case strings.Contains(msg, "SSL_CERTIFICATE_ERROR"):
+		return ErrorSSL
+	case strings.Contains(msg, "INVALID_URL"):
+		return ErrorInvalidUrl
+	case strings.Contains(msg, "OVER_QUOTA"):
+		return ErrorOverQuota
+	}
+	return ErrorFetch
+}
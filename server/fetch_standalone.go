@@ -0,0 +1,150 @@
+//go:build !appengine
+// +build !appengine
+
+package main
+
+import (
+	"crypto/x509"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	dialer = &net.Dialer{
+		Timeout:   10 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	// 不使用环境变量里的代理，连接的地址必须是检查过的地址
+	transport = &http.Transport{
+		Dial:                  dialChecked,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: fetchDeadline,
+	}
+
+	nonceLock sync.Mutex
+	// nonce和过期时间，只在本进程内有效
+	nonces = make(map[string]time.Time)
+	// 下次清理过期nonce的时间
+	nonceSweep time.Time
+
+	usageLock sync.Mutex
+	// 用户的用量，重启后重新计数
+	usages = make(map[string]int64)
+	// usages的key带有日期，日期变化时清除前一天的计数
+	usageDay string
+)
+
+// 独立运行时的Fetcher，日志输出到标准错误
+type httpFetcher struct {
+	*http.Transport
+	remote string
+}
+
+func newFetcher(r *http.Request) Fetcher {
+	return &httpFetcher{transport, r.RemoteAddr}
+}
+
+// 解析域名后按访问策略检查所有地址，再连接检查过的地址
+// 在连接时检查，避免检查之后DNS的结果变了，解析失败时直接返回错误
+func dialChecked(network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		if err = policy.checkIP(ip); err != nil {
+			return nil, err
+		}
+	}
+	for _, ip := range ips {
+		var conn net.Conn
+		conn, err = dialer.Dial(network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// 独立运行时只有一个实例，用主机名区分不同的服务器
+func instanceID() string {
+	name, _ := os.Hostname()
+	return name
+}
+
+func (f *httpFetcher) Infof(format string, args ...interface{}) {
+	log.Printf("INFO "+f.remote+" "+format, args...)
+}
+
+func (f *httpFetcher) Warningf(format string, args ...interface{}) {
+	log.Printf("WARNING "+f.remote+" "+format, args...)
+}
+
+func (f *httpFetcher) Errorf(format string, args ...interface{}) {
+	log.Printf("ERROR "+f.remote+" "+format, args...)
+}
+
+func (f *httpFetcher) AddNonce(nonce string, expire time.Duration) (bool, error) {
+	nonceLock.Lock()
+	defer nonceLock.Unlock()
+	now := time.Now()
+	if now.After(nonceSweep) {
+		for k, t := range nonces {
+			if now.After(t) {
+				delete(nonces, k)
+			}
+		}
+		nonceSweep = now.Add(expire)
+	}
+	if t, ok := nonces[nonce]; ok && now.Before(t) {
+		return false, nil
+	}
+	nonces[nonce] = now.Add(expire)
+	return true, nil
+}
+
+func (f *httpFetcher) AddUsage(key string, delta int64) (int64, error) {
+	usageLock.Lock()
+	defer usageLock.Unlock()
+	day := time.Now().UTC().Format("20060102")
+	if day != usageDay {
+		usages = make(map[string]int64)
+		usageDay = day
+	}
+	usages[key] += delta
+	return usages[key], nil
+}
+
+func (f *httpFetcher) GetCache(key string) ([]byte, bool) {
+	return memCache.get(key)
+}
+
+func (f *httpFetcher) SetCache(key string, value []byte, expire time.Duration) {
+	memCache.set(key, value, expire)
+}
+
+func (f *httpFetcher) ErrorCode(err error) ErrorCode {
+	if _, ok := err.(*DeniedError); ok {
+		return ErrorDenied
+	}
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		return ErrorDeadline
+	}
+	switch err.(type) {
+	case x509.UnknownAuthorityError, x509.HostnameError, x509.CertificateInvalidError:
+		return ErrorSSL
+	}
+	if strings.Contains(err.Error(), "unsupported protocol scheme") {
+		return ErrorInvalidUrl
+	}
+	return ErrorFetch
+}
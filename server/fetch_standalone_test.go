@@ -0,0 +1,44 @@
+//go:build !appengine
+// +build !appengine
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDialChecked(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+	defer func(deny bool) { policy.DenyPrivate = deny }(policy.DenyPrivate)
+	f := newFetcher(httptest.NewRequest("POST", "/", nil))
+	// 域名在检查时不解析，连接时解析出回环地址
+	url := strings.Replace(ts.URL, "127.0.0.1", "localhost", 1)
+	for _, tt := range []struct {
+		deny bool
+		url  string
+		code ErrorCode
+	}{
+		{true, url, ErrorDenied},
+		{true, ts.URL, ErrorDenied},
+		{false, url, 0},
+		{true, "http://no-such-host.invalid/", ErrorFetch},
+	} {
+		policy.DenyPrivate = tt.deny
+		req, _ := http.NewRequest("GET", tt.url, nil)
+		resp, err := f.RoundTrip(req)
+		if err == nil {
+			resp.Body.Close()
+			if tt.code != 0 {
+				t.Errorf("%s deny %v: no error", tt.url, tt.deny)
+			}
+			continue
+		}
+		if code := f.ErrorCode(err); code != tt.code {
+			t.Errorf("%s deny %v: %v %v, want %v", tt.url, tt.deny, code, err, tt.code)
+		}
+	}
+}
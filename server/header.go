@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// 逐跳的头部，只对一个连接有效，不能转发，参考RFC 7230 6.1
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// 服务器端和urlfetch能够原样转发的压缩方式，其他的去掉
+// br也会去掉：urlfetch只认识gzip，br的应答不保证原样转发，浏览器会退回gzip
+var acceptEncodings = []string{"gzip", "deflate", "identity"}
+
+// 隐私规则，请求的域名匹配Domains时去掉Headers里面的头部
+// Domains按后缀匹配，比如".example.com"，为空时匹配所有域名
+type PrivacyRule struct {
+	Domains []string `toml:"domains"`
+	Headers []string `toml:"headers"`
+}
+
+// 去掉逐跳头部，包括Connection里面列出的头部
+func removeHopHeaders(h http.Header) {
+	for _, v := range h["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// 只保留acceptEncodings里面的压缩方式
+func filterAcceptEncoding(h http.Header) {
+	v := h.Get("Accept-Encoding")
+	if v == "" {
+		return
+	}
+	var kept []string
+	for _, item := range strings.Split(v, ",") {
+		item = strings.TrimSpace(item)
+		coding := strings.ToLower(strings.TrimSpace(strings.SplitN(item, ";", 2)[0]))
+		for _, e := range acceptEncodings {
+			if coding == e {
+				kept = append(kept, item)
+				break
+			}
+		}
+	}
+	if len(kept) == 0 {
+		h.Del("Accept-Encoding")
+	} else {
+		h.Set("Accept-Encoding", strings.Join(kept, ", "))
+	}
+}
+
+func matchDomain(domains []string, host string) bool {
+	if len(domains) == 0 {
+		return true
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	for _, d := range domains {
+		d = strings.TrimPrefix(strings.ToLower(d), ".")
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// 请求转发之前的处理，客户端编码之前和服务器端获取之前都要调用
+// Content-Length由body决定，不转发
+func sanitizeRequest(h http.Header, host string, rules []PrivacyRule) {
+	removeHopHeaders(h)
+	h.Del("Content-Length")
+	filterAcceptEncoding(h)
+	for _, rule := range rules {
+		if matchDomain(rule.Domains, host) {
+			for _, name := range rule.Headers {
+				h.Del(name)
+			}
+		}
+	}
+}
+
+// 应答转发之前的处理，服务器端编码之前和客户端返回给浏览器之前都要调用
+// Content-Length由调用者根据实际返回的body设置
+func sanitizeResponse(h http.Header) {
+	removeHopHeaders(h)
+}
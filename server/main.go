@@ -1,79 +1,440 @@
 package main
 
 import (
-	"appengine"
-	"appengine/urlfetch"
+	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
 const (
-	version = "0.1"
+	version = "0.17"
 )
 
 func init() {
+	if encrypt {
+		sealKey = deriveKey(password, "secretbox")
+	}
+	signKey = deriveKey(password, "hmac")
+	initUsers()
 	http.HandleFunc("/", handler)
 }
 
+// 日志接口，appengine.Context实现了这个接口
+type Logger interface {
+	Infof(format string, args ...interface{})
+	Warningf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// 代理请求的运行环境
+// GAE上使用urlfetch和memcache，参考fetch_appengine.go
+// 独立运行时使用net/http和内存，参考fetch_standalone.go
+type Fetcher interface {
+	Logger
+	http.RoundTripper
+	// 记录nonce，nonce在expire时间内已经出现过时返回false
+	AddNonce(nonce string, expire time.Duration) (bool, error)
+	// 将获取失败的错误转换为错误类型
+	ErrorCode(err error) ErrorCode
+	// 计数器增加delta，返回增加后的值，用于统计用户的用量
+	AddUsage(key string, delta int64) (int64, error)
+	// 应答缓存的读写，参考cache.go
+	GetCache(key string) ([]byte, bool)
+	SetCache(key string, value []byte, expire time.Duration)
+}
+
+// 获取目标网站的超时时间
+const fetchDeadline = 60 * time.Second
+
 func handler(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case "GET":
-		fmt.Fprint(w, "version:", version)
+	switch {
+	case r.Method == "GET" && r.URL.Path == statusPath:
+		status(w, r)
+	case r.Method == "GET":
+		// 客户端启动时通过这个应答检查协议版本和配置是否一致
+		fmt.Fprintf(w, "version:%s\nprotocol:%d\ncaps:%s\n", version, protocolVersion, strings.Join(capabilities(), ","))
 	default:
 		proxy(w, r)
 	}
 }
 
+// 服务器端支持的功能，seal只在配置了加密时出现，users只在配置了用户时出现
+func capabilities() []string {
+	caps := []string{"sign", "status"}
+	if encrypt {
+		caps = append(caps, "seal")
+	}
+	if len(users) > 0 {
+		caps = append(caps, "users")
+	}
+	return caps
+}
+
+const (
+	// 批量应答的最大长度，GAE的应答不能超过32M
+	maxBatchReplySize = 30 * 1024 * 1024
+	// 批量请求同时获取的数量，每个获取都缓存在内存里
+	batchParallel = 8
+)
+
+// 批量应答的总长度超过了maxBatchReplySize
+var ErrBatchTooLarge = errors.New("batch reply too large")
+
+// GAE上没法拒绝启动，每个实例在第一个请求时记录一次错误
+var emptyPasswordOnce sync.Once
+
 func proxy(w http.ResponseWriter, r *http.Request) error {
-	c := appengine.NewContext(r)
-	client := urlfetch.Client(c)
-	client.Transport.(*urlfetch.Transport).Deadline = time.Second * 60
+	f := newFetcher(r)
+	emptyPasswordOnce.Do(func() {
+		if names := emptyPasswords(); len(names) > 0 {
+			f.Errorf("Empty password: %v, anyone can sign requests, set it in config.go", names)
+		}
+	})
+
+	br := bufio.NewReader(r.Body)
+	if isBatch(br) {
+		return proxyBatch(f, w, br)
+	}
+	status, err := fetch(f, br, w)
+	if err != nil {
+		replyError(w, status, err)
+	}
+	return err
+}
+
+// 将fetch的错误返回给客户端
+func replyError(w http.ResponseWriter, status int, err error) {
+	switch status {
+	case 0:
+		// 应答已经开始写入，没法再返回错误
+	case http.StatusForbidden:
+		http.Error(w, http.StatusText(status), status)
+	default:
+		if _, ok := err.(*VersionError); ok {
+			w.Header().Set("X-GW-Protocol", strconv.Itoa(protocolVersion))
+		}
+		http.Error(w, err.Error(), status)
+	}
+}
 
-	data, err := decode(r.Body)
+// 并发处理批量请求，应答按完成的顺序返回
+// 处理失败的请求返回空的应答，由客户端单独重新发送
+func proxyBatch(f Fetcher, w http.ResponseWriter, r *bufio.Reader) error {
+	count, err := readBatchHead(r)
 	if err != nil {
-		c.Errorf("decode failed: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		f.Errorf("decode batch failed: %v", err)
+		replyError(w, http.StatusBadRequest, err)
 		return err
 	}
+	frames := make([][]byte, count)
+	for i := range frames {
+		frames[i], err = readBatchFrame(r)
+		if err != nil {
+			f.Errorf("decode batch failed: %v", err)
+			replyError(w, http.StatusBadRequest, err)
+			return err
+		}
+	}
+
+	type result struct {
+		index int
+		frame []byte
+	}
+	results := make(chan result, count)
+	budget := &batchBudget{left: maxBatchReplySize}
+	sem := make(chan int, batchParallel)
+	for i, frame := range frames {
+		go func(i int, frame []byte) {
+			sem <- 1
+			defer func() {
+				<-sem
+			}()
+			buff := &batchBuffer{budget: budget}
+			if _, err := fetch(f, bytes.NewReader(frame), buff); err != nil {
+				buff.drop()
+			}
+			results <- result{i, buff.Bytes()}
+		}(i, frame)
+	}
+
+	err = writeBatchHead(w, count)
+	for i := 0; i < count; i++ {
+		res := <-results
+		if err == nil {
+			err = writeBatchReply(w, res.index, res.frame)
+		}
+	}
+	if err != nil {
+		f.Errorf("Encode batch failed: %v", err)
+	}
+	return err
+}
+
+// 解码请求帧，获取内容后将应答帧写入w
+// 获取失败时应答帧带有错误类型
+// 请求帧无法解码时，返回应该回复给客户端的HTTP状态码
+func fetch(f Fetcher, r io.Reader, w io.Writer) (int, error) {
+	cr := &countReader{r: r}
+	cw := &countWriter{w: w}
+	out := w
+	r, w = cr, cw
+	data, err := decode(r)
+	if err != nil {
+		stats.addError("bad frame")
+	}
+	if _, ok := err.(*VersionError); ok {
+		f.Errorf("decode failed: %v", err)
+		return http.StatusBadRequest, err
+	}
+	if err == ErrUnsealed || err == ErrOpen || err == ErrUnknownUser {
+		f.Errorf("decode failed: %v", err)
+		return http.StatusForbidden, err
+	}
+	if err != nil {
+		f.Errorf("decode failed: %v", err)
+		return http.StatusInternalServerError, err
+	}
 	defer data.Body.Close()
 
-	if data.Password != password {
-		c.Errorf("Password not match: %v, %v", data.Password, password)
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return err
+	var start = time.Now()
+	var host string
+	defer func() {
+		stats.addFetch(host, time.Since(start), cr.n, cw.n)
+	}()
+
+	err = verifyRequest(data)
+	if err != nil {
+		f.Errorf("Verify request failed: %v", err)
+		return replyFetchError(w, data, ErrorUnauthorized, err)
 	}
-	c.Infof("Fetch: %v %v", data.Method, data.Url)
+	// 压缩级别已经签名，校验之后再限制范围
+	data.CompressLevel = clampCompressLevel(data.CompressLevel)
+	// 在时间戳有效期内出现过的nonce都是重放的请求
+	added, err := f.AddNonce(data.Nonce, 2*maxClockSkew)
+	if err != nil {
+		f.Warningf("Check nonce failed: %v", err)
+	} else if !added {
+		f.Errorf("Replayed request: %v %v", data.Method, data.Url)
+		return replyFetchError(w, data, ErrorUnauthorized, errors.New("replayed request"))
+	}
+	f.Infof("Fetch: %v %v %v", data.User, data.Method, data.Url)
 
-	req, err := http.NewRequest(data.Method, data.Url, data.Body)
+	body, err := ioutil.ReadAll(data.Body)
 	if err != nil {
-		c.Errorf("Create request failed: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return err
+		f.Errorf("Read request body failed: %v", err)
+		return replyFetchError(w, data, ErrorFetch, err)
 	}
+	// 有body时由bytes.Reader决定Content-Length，没有body时不能发送chunked的空body
+	var reqBody io.Reader
+	if len(body) > 0 {
+		reqBody = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(data.Method, data.Url, reqBody)
+	if err != nil {
+		f.Errorf("Create request failed: %v", err)
+		return replyFetchError(w, data, ErrorInvalidUrl, err)
+	}
+	host = req.URL.Host
+	if err = policy.check(req.Method, req.URL.Scheme, req.URL.Host); err != nil {
+		f.Warningf("Denied: %v %v: %v", data.Method, data.Url, err)
+		return replyFetchError(w, data, ErrorDenied, err)
+	}
+	if u := findUser(data.User); u != nil {
+		if !u.allowed(req.URL.Host) {
+			f.Warningf("Forbidden domain: %v %v", u.Name, req.URL.Host)
+			return replyFetchError(w, data, ErrorForbidden, fmt.Errorf("user %s: domain %s not allowed", u.Name, req.URL.Host))
+		}
+		if err = u.checkQuota(f); err != nil {
+			f.Warningf("Quota exceeded: %v", err)
+			return replyFetchError(w, data, ErrorQuotaExceeded, err)
+		}
+		// 请求和应答的长度都计入用户的流量
+		defer func() {
+			u.addBytes(f, cr.n+cw.n)
+		}()
+	}
+	sanitizeRequest(data.Header, req.URL.Host, privacyRules)
 	for k, i := range data.Header {
 		for _, v := range i {
 			req.Header.Add(k, v)
 		}
 	}
-	resp, err := client.Transport.RoundTrip(req)
+	if b, ok := out.(*batchBuffer); ok && b.budget.full() {
+		// 前面的应答已经用完了批量应答的长度，不再获取
+		b.drop()
+		return replyFetchError(w, data, ErrorTooLarge, ErrBatchTooLarge)
+	}
+	var resp *http.Response
+	var hit bool
+	if cacheEnabled && cacheableRequest(req) {
+		resp, hit, err = fetchCached(f, req, func(req *http.Request) (*http.Response, error) {
+			return fetchOrigin(f, req, data)
+		})
+	} else {
+		resp, err = fetchOrigin(f, req, data)
+	}
 	if err != nil {
-		c.Errorf("Fetch failed: %v", err)
-		http.Error(w, err.Error(), http.StatusBadGateway)
-		return err
+		f.Errorf("Fetch failed: %v", err)
+		return replyFetchError(w, data, f.ErrorCode(err), err)
 	}
 	defer resp.Body.Close()
 
 	data.Status = resp.StatusCode
 	data.Method = ""
 	data.Url = ""
+	data.Timestamp = 0
+	data.Nonce = ""
+	data.Signature = ""
+	data.AutoRange = false
+	data.Parallel = 0
+	data.Digest = ""
+	data.CacheHit = hit
+	sanitizeResponse(resp.Header)
+	if resp.ContentLength >= 0 {
+		resp.Header.Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	} else {
+		resp.Header.Del("Content-Length")
+	}
 	data.Header = resp.Header
 	data.Body = resp.Body
-	err = encode(data, w)
+	err = encode(data, w, nil)
+	if b, ok := out.(*batchBuffer); ok && err == ErrBatchTooLarge {
+		// 写到一半超过了批量应答的限制，丢掉已经写的部分，让客户端单独请求
+		f.Warningf("Batch reply too large: %v", req.URL)
+		b.drop()
+		return replyFetchError(w, data, ErrorTooLarge, err)
+	}
 	if err != nil {
-		c.Errorf("Encode response failed: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return err
+		f.Errorf("Encode response failed: %v", err)
+		return 0, err
+	}
+	return 0, nil
+}
+
+// 从目标网站获取
+func fetchOrigin(f Fetcher, req *http.Request, data *HttpData) (*http.Response, error) {
+	var resp *http.Response
+	var err error
+	if data.Parallel > 1 {
+		resp, err = fetchMulti(f, req, data.Parallel)
+	}
+	if data.Parallel <= 1 || err == ErrNoRange {
+		resp, err = f.RoundTrip(req)
+	}
+	if err == nil && data.AutoRange && data.Method == "GET" && resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		// 目标网站拒绝了客户端自动添加的Range，去掉Range重新获取
+		resp.Body.Close()
+		req.Header.Del("Range")
+		resp, err = f.RoundTrip(req)
+	}
+	if err != nil && f.ErrorCode(err) == ErrorTooLarge {
+		// 超过了urlfetch的限制，尝试分段获取
+		splitResp, splitErr := fetchSplit(f, req)
+		if splitErr == nil {
+			return splitResp, nil
+		}
+		f.Warningf("Split fetch failed: %v", splitErr)
+	}
+	return resp, err
+}
+
+// 获取失败时返回带错误类型的应答帧，客户端根据类型处理
+func replyFetchError(w io.Writer, data *HttpData, code ErrorCode, err error) (int, error) {
+	stats.addError(code.String())
+	reply := &HttpData{
+		User:            data.User,
+		Error:           code,
+		ErrorMsg:        err.Error(),
+		CompressMinSize: data.CompressMinSize,
+		CompressLevel:   data.CompressLevel,
+	}
+	return 0, encode(reply, w, nil)
+}
+
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// 批量应答的剩余长度，所有并发的获取共用
+// 有一个应答超出之后就不再开始新的获取
+type batchBudget struct {
+	mu   sync.Mutex
+	left int
+	over bool
+}
+
+func (b *batchBudget) take(n int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if n > b.left {
+		b.over = true
+		return false
+	}
+	b.left -= n
+	return true
+}
+
+func (b *batchBudget) give(n int) {
+	b.mu.Lock()
+	b.left += n
+	b.mu.Unlock()
+}
+
+func (b *batchBudget) full() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.over
+}
+
+// 批量请求中一个应答帧的缓冲，写入的长度从budget中扣除，超出时返回ErrBatchTooLarge
+// drop之后只用来写错误帧，不再计入budget
+type batchBuffer struct {
+	buf     bytes.Buffer
+	budget  *batchBudget
+	dropped bool
+}
+
+func (b *batchBuffer) Write(p []byte) (int, error) {
+	if !b.dropped && !b.budget.take(len(p)) {
+		return 0, ErrBatchTooLarge
+	}
+	return b.buf.Write(p)
+}
+
+func (b *batchBuffer) Bytes() []byte {
+	return b.buf.Bytes()
+}
+
+func (b *batchBuffer) drop() {
+	if !b.dropped {
+		b.budget.give(b.buf.Len())
+		b.dropped = true
 	}
-	return nil
+	b.buf.Reset()
 }
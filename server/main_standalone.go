@@ -0,0 +1,70 @@
+//go:build !appengine
+// +build !appengine
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"flag"
+	"log"
+	"math/big"
+	"net/http"
+	"time"
+)
+
+// 不在GAE上时，作为独立的服务器运行
+// 客户端的ip配置为服务器的地址，比如 ip = "1.2.3.4:443"
+func main() {
+	listen := flag.String("listen", ":443", "listen address")
+	certFile := flag.String("cert", "", "TLS certificate file, generate a self-signed one if empty")
+	keyFile := flag.String("key", "", "TLS private key file")
+	flag.Parse()
+	if names := emptyPasswords(); len(names) > 0 {
+		log.Fatalln("Empty password:", names, "anyone can sign requests, set it in config.go")
+	}
+
+	var cert tls.Certificate
+	var err error
+	if *certFile != "" {
+		cert, err = tls.LoadX509KeyPair(*certFile, *keyFile)
+	} else {
+		// 客户端不校验服务器端的证书，自签名即可
+		cert, err = selfSignedCert()
+	}
+	if err != nil {
+		log.Fatalln("Load cert failed:", err)
+	}
+
+	server := &http.Server{
+		Addr:      *listen,
+		Handler:   http.DefaultServeMux,
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+	}
+	log.Println("Listen:", *listen)
+	log.Fatalln("Listen failed:", server.ListenAndServeTLS("", ""))
+}
+
+func selfSignedCert() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "gowalk"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
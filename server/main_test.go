@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFetchReplay(t *testing.T) {
+	data := &HttpData{Method: "GET", Url: "http://127.0.0.1/", Header: make(http.Header)}
+	if err := signRequest(data, nil); err != nil {
+		t.Fatal(err)
+	}
+	var frame bytes.Buffer
+	if err := encode(data, &frame, nil); err != nil {
+		t.Fatal(err)
+	}
+	f := newFetcher(httptest.NewRequest("POST", "/", nil))
+	// 第一次通过签名校验，被访问策略拒绝，第二次是重放的请求
+	for i, want := range []ErrorCode{ErrorDenied, ErrorUnauthorized} {
+		var reply bytes.Buffer
+		if _, err := fetch(f, bytes.NewReader(frame.Bytes()), &reply); err != nil {
+			t.Fatalf("fetch %d: %v", i, err)
+		}
+		got, err := decode(&reply)
+		if err != nil {
+			t.Fatalf("decode %d: %v", i, err)
+		}
+		if got.Error != want {
+			t.Errorf("fetch %d: %v, want %v", i, got.Error, want)
+		}
+	}
+}
+
+func TestBatchBuffer(t *testing.T) {
+	budget := &batchBudget{left: 10}
+	a := &batchBuffer{budget: budget}
+	b := &batchBuffer{budget: budget}
+	if _, err := a.Write(make([]byte, 6)); err != nil {
+		t.Fatalf("write a: %v", err)
+	}
+	if _, err := b.Write(make([]byte, 6)); err != ErrBatchTooLarge {
+		t.Fatalf("write b: %v, want %v", err, ErrBatchTooLarge)
+	}
+	if !budget.full() {
+		t.Errorf("budget not full after overflow")
+	}
+	// 丢掉的帧归还长度，之后写的错误帧不计入
+	b.drop()
+	if _, err := b.Write(make([]byte, 20)); err != nil || len(b.Bytes()) != 20 {
+		t.Errorf("write dropped: %v, %d bytes", err, len(b.Bytes()))
+	}
+	if _, err := a.Write(make([]byte, 4)); err != nil {
+		t.Errorf("write a again: %v", err)
+	}
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// 分段获取时每段的大小
+	splitPartSize = 4 * 1024 * 1024
+	// 同时获取的段数
+	splitParallel = 4
+	// 客户端请求并发获取时，最多同时获取的段数
+	maxParallel = 8
+	// 带Range时一次返回的最大长度，保证应答不超过GAE的限制
+	// 剩下的部分由客户端根据Content-Range继续请求
+	maxSplitSize = 24 * 1024 * 1024
+)
+
+var (
+	// 目标网站不支持Range，无法分段获取
+	ErrNoRange = errors.New("range not supported")
+	// 分段获取期间目标内容发生了变化
+	ErrChanged = errors.New("content changed")
+)
+
+// 从Content-Range中解析出起止位置和总长度
+func parseContentRange(s string) (start, end, total int64, ok bool) {
+	if !strings.HasPrefix(s, "bytes ") {
+		return
+	}
+	var err error
+	part := strings.SplitN(s[len("bytes "):], "/", 2)
+	if len(part) != 2 {
+		return
+	}
+	se := strings.SplitN(part[0], "-", 2)
+	if len(se) != 2 {
+		return
+	}
+	if start, err = strconv.ParseInt(se[0], 10, 64); err != nil {
+		return
+	}
+	if end, err = strconv.ParseInt(se[1], 10, 64); err != nil {
+		return
+	}
+	if total, err = strconv.ParseInt(part[1], 10, 64); err != nil {
+		return
+	}
+	return start, end, total, start <= end && end < total
+}
+
+// 解析请求的Range，只支持单个范围，返回的end包含在范围内
+func parseRequestRange(s string, total int64) (start, end int64, ok bool) {
+	if !strings.HasPrefix(s, "bytes=") || strings.Contains(s, ",") {
+		return
+	}
+	se := strings.SplitN(s[len("bytes="):], "-", 2)
+	if len(se) != 2 {
+		return
+	}
+	var err error
+	if se[0] == "" {
+		// bytes=-n，最后n个字节
+		var n int64
+		if n, err = strconv.ParseInt(se[1], 10, 64); err != nil || n <= 0 {
+			return
+		}
+		if n > total {
+			n = total
+		}
+		return total - n, total - 1, true
+	}
+	if start, err = strconv.ParseInt(se[0], 10, 64); err != nil || start >= total {
+		return
+	}
+	end = total - 1
+	if se[1] != "" {
+		if end, err = strconv.ParseInt(se[1], 10, 64); err != nil || end < start {
+			return
+		}
+		if end >= total {
+			end = total - 1
+		}
+	}
+	return start, end, true
+}
+
+// 获取一段内容，检查长度、ETag和Last-Modified和第一段一致之后才返回
+func fetchPart(f Fetcher, req *http.Request, start, end int64, probe *http.Response, total int64) ([]byte, error) {
+	part, err := http.NewRequest("GET", req.URL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range req.Header {
+		part.Header[k] = v
+	}
+	part.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	resp, err := f.RoundTrip(part)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return nil, ErrNoRange
+	}
+	s, e, t, ok := parseContentRange(resp.Header.Get("Content-Range"))
+	if !ok || s != start || e != end || t != total {
+		return nil, ErrChanged
+	}
+	for _, k := range []string{"ETag", "Last-Modified"} {
+		if resp.Header.Get(k) != probe.Header.Get(k) {
+			return nil, ErrChanged
+		}
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err == nil && int64(len(body)) != end-start+1 {
+		err = ErrChanged
+	}
+	return body, err
+}
+
+// 应答超过urlfetch的限制时，先取第一个字节得到总长度和ETag，再分段并发获取
+// 每段检查长度和ETag、Last-Modified之后才按顺序流式返回，不会把整个内容放在内存里
+// 没有Range并且不超过maxSplitSize的请求按200返回全部内容，其他情况按206返回，
+// 最多maxSplitSize，剩下的部分由客户端根据Content-Range继续请求
+func fetchSplit(f Fetcher, req *http.Request) (*http.Response, error) {
+	if req.Method != "GET" {
+		return nil, ErrNoRange
+	}
+	probeReq, err := http.NewRequest("GET", req.URL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range req.Header {
+		probeReq.Header[k] = v
+	}
+	probeReq.Header.Set("Range", "bytes=0-0")
+	probe, err := f.RoundTrip(probeReq)
+	if err != nil {
+		return nil, err
+	}
+	probe.Body.Close()
+	if probe.StatusCode != http.StatusPartialContent {
+		return nil, ErrNoRange
+	}
+	_, _, total, ok := parseContentRange(probe.Header.Get("Content-Range"))
+	if !ok {
+		return nil, ErrNoRange
+	}
+	// 没有ETag和Last-Modified时无法确认各段是同一个内容
+	if probe.Header.Get("ETag") == "" && probe.Header.Get("Last-Modified") == "" {
+		return nil, ErrNoRange
+	}
+
+	header := make(http.Header)
+	for k, v := range probe.Header {
+		header[k] = v
+	}
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     header,
+	}
+	start, end := int64(0), total-1
+	r := req.Header.Get("Range")
+	if r != "" {
+		if start, end, ok = parseRequestRange(r, total); !ok {
+			return nil, ErrNoRange
+		}
+	}
+	if r != "" || end-start+1 > maxSplitSize {
+		// 全部内容超过GAE的应答限制时也按206返回第一部分
+		if end-start+1 > maxSplitSize {
+			end = start + maxSplitSize - 1
+		}
+		resp.StatusCode = http.StatusPartialContent
+		header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, total))
+	} else {
+		header.Del("Content-Range")
+	}
+	resp.ContentLength = end - start + 1
+	header.Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	f.Infof("Split fetch: %v bytes=%d-%d/%d", req.URL, start, end, total)
+
+	body := newMultiBody(nil, start, end, splitParallel)
+	go body.fetch(f, req, probe, total)
+	resp.Body = body
+	return resp, nil
+}
+
+// 请求的Range为 bytes=start-end 或者 bytes=start- 时返回起止位置，end为-1表示到结尾
+func parseStartRange(s string) (start, end int64, ok bool) {
+	if !strings.HasPrefix(s, "bytes=") || strings.Contains(s, ",") {
+		return
+	}
+	se := strings.SplitN(s[len("bytes="):], "-", 2)
+	if len(se) != 2 || se[0] == "" {
+		return
+	}
+	var err error
+	if start, err = strconv.ParseInt(se[0], 10, 64); err != nil {
+		return
+	}
+	end = -1
+	if se[1] != "" {
+		if end, err = strconv.ParseInt(se[1], 10, 64); err != nil || end < start {
+			return
+		}
+	}
+	return start, end, true
+}
+
+// 客户端请求并发获取时，第一段直接获取，从应答得到总长度和ETag
+// 剩下的段并发获取，和第一段一起按顺序流式返回，最多maxSplitSize
+// 第一段不是206、只需要一段或者没有ETag和Last-Modified时，直接返回第一段的应答
+func fetchMulti(f Fetcher, req *http.Request, parallel int) (*http.Response, error) {
+	if req.Method != "GET" {
+		return nil, ErrNoRange
+	}
+	start, end, ok := parseStartRange(req.Header.Get("Range"))
+	if !ok {
+		return nil, ErrNoRange
+	}
+	if parallel > maxParallel {
+		parallel = maxParallel
+	}
+	firstEnd := start + splitPartSize - 1
+	if end != -1 && firstEnd > end {
+		firstEnd = end
+	}
+	firstReq, err := http.NewRequest("GET", req.URL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range req.Header {
+		firstReq.Header[k] = v
+	}
+	firstReq.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, firstEnd))
+	first, err := f.RoundTrip(firstReq)
+	if err != nil || first.StatusCode != http.StatusPartialContent {
+		return first, err
+	}
+	s, e, total, ok := parseContentRange(first.Header.Get("Content-Range"))
+	if !ok || s != start || e != firstEnd && e != total-1 {
+		return first, nil
+	}
+	if end == -1 || end >= total {
+		end = total - 1
+	}
+	if end-start+1 > maxSplitSize {
+		end = start + maxSplitSize - 1
+	}
+	// 没有ETag和Last-Modified时无法确认各段是同一个内容，只返回第一段
+	if e >= end || first.Header.Get("ETag") == "" && first.Header.Get("Last-Modified") == "" {
+		return first, nil
+	}
+	f.Infof("Multi fetch: %v bytes=%d-%d/%d parallel %d", req.URL, start, end, total, parallel)
+
+	body := newMultiBody(first.Body, e+1, end, parallel-1)
+	go body.fetch(f, req, first, total)
+
+	header := make(http.Header)
+	for k, v := range first.Header {
+		header[k] = v
+	}
+	header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, total))
+	return &http.Response{
+		StatusCode:    http.StatusPartialContent,
+		Header:        header,
+		ContentLength: end - start + 1,
+		Body:          body,
+	}, nil
+}
+
+type partResult struct {
+	body []byte
+	err  error
+}
+
+// 按顺序读出第一段和后面并发获取的段
+// 读完一段之后才释放这一段占用的并发数，避免读得慢时缓存太多的段
+type multiBody struct {
+	first  io.ReadCloser
+	parts  []chan partResult
+	ranges [][2]int64
+	cur    *bytes.Reader
+	next   int
+	sem    chan int
+	quit   chan bool
+	closed bool
+}
+
+// first之后的[start, end]按splitPartSize分段，最多同时获取parallel段
+func newMultiBody(first io.ReadCloser, start, end int64, parallel int) *multiBody {
+	b := &multiBody{
+		first: first,
+		quit:  make(chan bool),
+		sem:   make(chan int, parallel),
+	}
+	for pos := start; pos <= end; pos += splitPartSize {
+		pe := pos + splitPartSize - 1
+		if pe > end {
+			pe = end
+		}
+		b.parts = append(b.parts, make(chan partResult, 1))
+		b.ranges = append(b.ranges, [2]int64{pos, pe})
+	}
+	return b
+}
+
+func (b *multiBody) fetch(f Fetcher, req *http.Request, first *http.Response, total int64) {
+	for i, r := range b.ranges {
+		select {
+		case b.sem <- 1:
+		case <-b.quit:
+			return
+		}
+		go func(i int, start, end int64) {
+			body, err := fetchPart(f, req, start, end, first, total)
+			if err != nil {
+				f.Warningf("Fetch part failed: bytes=%d-%d: %v", start, end, err)
+			}
+			b.parts[i] <- partResult{body, err}
+		}(i, r[0], r[1])
+	}
+}
+
+func (b *multiBody) Read(p []byte) (int, error) {
+	if b.first != nil {
+		n, err := b.first.Read(p)
+		if err == io.EOF {
+			b.first.Close()
+			b.first = nil
+			err = nil
+		}
+		return n, err
+	}
+	for b.cur == nil || b.cur.Len() == 0 {
+		if b.cur != nil {
+			// 上一段读完，释放并发数
+			<-b.sem
+			b.cur = nil
+		}
+		if b.next >= len(b.parts) {
+			return 0, io.EOF
+		}
+		res := <-b.parts[b.next]
+		b.next++
+		if res.err != nil {
+			return 0, res.err
+		}
+		b.cur = bytes.NewReader(res.body)
+	}
+	return b.cur.Read(p)
+}
+
+func (b *multiBody) Close() error {
+	if !b.closed {
+		b.closed = true
+		close(b.quit)
+	}
+	if b.first != nil {
+		return b.first.Close()
+	}
+	return nil
+}
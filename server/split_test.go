@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 直接访问测试服务器，不经过访问策略
+type splitFetcher struct {
+	Fetcher
+}
+
+func (f *splitFetcher) RoundTrip(req *http.Request) (*http.Response, error) {
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestFetchSplit(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), (2*splitPartSize+splitPartSize/2)/10)
+	modified := time.Unix(1500000000, 0)
+	var requests int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/file", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "file", modified, bytes.NewReader(content))
+	})
+	mux.HandleFunc("/changing", func(w http.ResponseWriter, r *http.Request) {
+		// 第一个字节之后内容就变了
+		n := atomic.AddInt32(&requests, 1)
+		http.ServeContent(w, r, "file", modified.Add(time.Duration(n)*time.Second), bytes.NewReader(content))
+	})
+	large := bytes.Repeat([]byte("0123456789"), (maxSplitSize+splitPartSize)/10)
+	mux.HandleFunc("/large", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "large", modified, bytes.NewReader(large))
+	})
+	mux.HandleFunc("/novalidator", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	f := &splitFetcher{newFetcher(httptest.NewRequest("POST", "/", nil))}
+
+	tests := []struct {
+		name   string
+		path   string
+		rng    string
+		status int
+		body   []byte
+		err    error
+	}{
+		{"plain", "/file", "", 200, content, nil},
+		{"range", "/file", "bytes=100-" + strconv.Itoa(splitPartSize+100), 206, content[100 : splitPartSize+101], nil},
+		{"open range", "/file", "bytes=" + strconv.Itoa(splitPartSize) + "-", 206, content[splitPartSize:], nil},
+		{"suffix", "/file", "bytes=-10", 206, content[len(content)-10:], nil},
+		{"large", "/large", "", 206, large[:maxSplitSize], nil},
+		{"changing", "/changing", "", 200, nil, ErrChanged},
+		{"no validator", "/novalidator", "", 0, nil, ErrNoRange},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", ts.URL+tt.path, nil)
+		if tt.rng != "" {
+			req.Header.Set("Range", tt.rng)
+		}
+		resp, err := fetchSplit(f, req)
+		if err != nil {
+			if err != tt.err {
+				t.Errorf("%s: %v, want %v", tt.name, err, tt.err)
+			}
+			continue
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, resp.StatusCode, tt.status)
+		}
+		if err != tt.err {
+			t.Errorf("%s: read body: %v, want %v", tt.name, err, tt.err)
+		}
+		if tt.err != nil {
+			continue
+		}
+		if !bytes.Equal(body, tt.body) || resp.ContentLength != int64(len(tt.body)) {
+			t.Errorf("%s: body %d bytes, length %d, want %d", tt.name, len(body), resp.ContentLength, len(tt.body))
+		}
+		if resp.StatusCode == 200 && resp.Header.Get("Content-Range") != "" {
+			t.Errorf("%s: Content-Range %q in 200", tt.name, resp.Header.Get("Content-Range"))
+		}
+	}
+}
+
+func TestFetchMulti(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), (maxSplitSize+splitPartSize)/10)
+	modified := time.Unix(1500000000, 0)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/file", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "file", modified, bytes.NewReader(content))
+	})
+	mux.HandleFunc("/novalidator", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	f := &splitFetcher{newFetcher(httptest.NewRequest("POST", "/", nil))}
+
+	tests := []struct {
+		name string
+		path string
+		rng  string
+		body []byte
+	}{
+		{"range", "/file", "bytes=100-" + strconv.Itoa(splitPartSize+100), content[100 : splitPartSize+101]},
+		{"capped", "/file", "bytes=10-", content[10 : maxSplitSize+10]},
+		{"no validator", "/novalidator", "bytes=0-", content[:splitPartSize]},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", ts.URL+tt.path, nil)
+		req.Header.Set("Range", tt.rng)
+		resp, err := fetchMulti(f, req, 4)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || resp.StatusCode != 206 {
+			t.Errorf("%s: status %d, %v", tt.name, resp.StatusCode, err)
+			continue
+		}
+		if !bytes.Equal(body, tt.body) {
+			t.Errorf("%s: body %d bytes, want %d", tt.name, len(body), len(tt.body))
+		}
+	}
+}
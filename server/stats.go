@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// 保留最近多少次请求的耗时，用于计算百分位
+	latencySamples = 1024
+	// 最多统计多少个目标网站，超过后新的网站不再统计
+	maxStatsHosts = 1000
+	// 状态里面返回访问最多的网站数量
+	topHosts = 10
+)
+
+// 本实例启动以来的统计，GAE上每个实例分别统计
+type serverStats struct {
+	lock     sync.Mutex
+	start    time.Time
+	fetches  int64
+	hits     int64
+	errors   map[string]int64
+	bytesIn  int64
+	bytesOut int64
+	latency  []time.Duration
+	next     int
+	hosts    map[string]int64
+}
+
+var stats = &serverStats{
+	start:  time.Now(),
+	errors: make(map[string]int64),
+	hosts:  make(map[string]int64),
+}
+
+// 记录一次请求
+func (s *serverStats) addFetch(host string, d time.Duration, in, out int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.fetches++
+	s.bytesIn += in
+	s.bytesOut += out
+	if len(s.latency) < latencySamples {
+		s.latency = append(s.latency, d)
+	} else {
+		s.latency[s.next] = d
+		s.next = (s.next + 1) % latencySamples
+	}
+	if host != "" {
+		if _, ok := s.hosts[host]; ok || len(s.hosts) < maxStatsHosts {
+			s.hosts[host]++
+		}
+	}
+}
+
+// 记录一次缓存命中
+func (s *serverStats) addCacheHit() {
+	s.lock.Lock()
+	s.hits++
+	s.lock.Unlock()
+}
+
+// 记录一次错误，kind为错误类型的名字
+func (s *serverStats) addError(kind string) {
+	s.lock.Lock()
+	s.errors[kind]++
+	s.lock.Unlock()
+}
+
+type hostCount struct {
+	Host  string `json:"host"`
+	Count int64  `json:"count"`
+}
+
+type hostCounts []hostCount
+
+func (h hostCounts) Len() int      { return len(h) }
+func (h hostCounts) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h hostCounts) Less(i, j int) bool {
+	if h[i].Count != h[j].Count {
+		return h[i].Count > h[j].Count
+	}
+	return h[i].Host < h[j].Host
+}
+
+// 状态应答，时间单位为毫秒
+type statusReply struct {
+	Version  string           `json:"version"`
+	Protocol int              `json:"protocol"`
+	Instance string           `json:"instance"`
+	Start    time.Time        `json:"start"`
+	Uptime   int64            `json:"uptime"`
+	Fetches  int64            `json:"fetches"`
+	Hits     int64            `json:"cache_hits"`
+	Errors   map[string]int64 `json:"errors"`
+	BytesIn  int64            `json:"bytes_in"`
+	BytesOut int64            `json:"bytes_out"`
+	Latency  map[string]int64 `json:"latency"`
+	Hosts    hostCounts       `json:"hosts"`
+}
+
+func (s *serverStats) snapshot() *statusReply {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	reply := &statusReply{
+		Version:  version,
+		Protocol: protocolVersion,
+		Instance: instanceID(),
+		Start:    s.start,
+		Uptime:   int64(time.Since(s.start) / time.Millisecond),
+		Fetches:  s.fetches,
+		Hits:     s.hits,
+		Errors:   make(map[string]int64),
+		BytesIn:  s.bytesIn,
+		BytesOut: s.bytesOut,
+		Latency:  make(map[string]int64),
+	}
+	for k, v := range s.errors {
+		reply.Errors[k] = v
+	}
+	if len(s.latency) > 0 {
+		latency := make([]int64, len(s.latency))
+		for i, d := range s.latency {
+			latency[i] = int64(d / time.Millisecond)
+		}
+		sort.Sort(int64s(latency))
+		for _, p := range []int{50, 90, 99} {
+			reply.Latency["p"+strconv.Itoa(p)] = latency[(len(latency)-1)*p/100]
+		}
+	}
+	for k, v := range s.hosts {
+		reply.Hosts = append(reply.Hosts, hostCount{k, v})
+	}
+	sort.Sort(reply.Hosts)
+	if len(reply.Hosts) > topHosts {
+		reply.Hosts = reply.Hosts[:topHosts]
+	}
+	return reply
+}
+
+type int64s []int64
+
+func (a int64s) Len() int           { return len(a) }
+func (a int64s) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a int64s) Less(i, j int) bool { return a[i] < a[j] }
+
+// 返回本实例的统计，请求需要按照signStatus签名
+// 配置了用户时只有Admin用户可以查看
+func status(w http.ResponseWriter, r *http.Request) {
+	f := newFetcher(r)
+	data, err := readStatusRequest(r.Header)
+	if err == nil {
+		err = verifyRequest(data)
+	}
+	if err == nil && len(users) > 0 {
+		if u := findUser(data.User); u == nil || !u.Admin {
+			err = ErrSignature
+		}
+	}
+	if err == nil {
+		var added bool
+		added, err = f.AddNonce(data.Nonce, 2*maxClockSkew)
+		if err == nil && !added {
+			err = ErrSignature
+		}
+	}
+	if err != nil {
+		f.Warningf("Status request rejected: %v", err)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats.snapshot())
+}
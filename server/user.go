@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// 用户配置，参考config.go
+type User struct {
+	Name     string
+	Password string
+	// 每天(UTC)允许的流量，包括请求和应答，0为不限制
+	DailyBytes int64
+	// 每天允许的请求数，0为不限制
+	DailyRequests int64
+	// 允许访问的域名，包括子域名，为空时不限制
+	Domains []string
+	// 是否可以查看服务器状态
+	Admin bool
+}
+
+type userKeyPair struct {
+	seal *[32]byte
+	sign *[32]byte
+}
+
+var (
+	userMap      = make(map[string]*User)
+	userKeyPairs = make(map[string]userKeyPair)
+)
+
+// 配置了用户时，按照用户名查找密钥
+func initUsers() {
+	if len(users) == 0 {
+		return
+	}
+	for i := range users {
+		u := &users[i]
+		var pair userKeyPair
+		if encrypt {
+			pair.seal = deriveKey(u.Password, "secretbox")
+		}
+		pair.sign = deriveKey(u.Password, "hmac")
+		userMap[u.Name] = u
+		userKeyPairs[u.Name] = pair
+	}
+	lookupKeys = func(name string) (seal, sign *[32]byte, err error) {
+		pair, ok := userKeyPairs[name]
+		if !ok {
+			return nil, nil, ErrUnknownUser
+		}
+		return pair.seal, pair.sign, nil
+	}
+}
+
+// 密码为空时签名的密钥任何人都能算出来，签名起不到认证的作用
+// 返回密码为空的用户名，没有配置用户时检查password，返回"password"
+func emptyPasswords() []string {
+	if len(users) == 0 {
+		if password == "" {
+			return []string{"password"}
+		}
+		return nil
+	}
+	var names []string
+	for _, u := range users {
+		if u.Password == "" {
+			names = append(names, u.Name)
+		}
+	}
+	return names
+}
+
+// 没有配置用户时返回nil
+func findUser(name string) *User {
+	return userMap[name]
+}
+
+// 用户超出了每日的配额
+type QuotaError struct {
+	User  string
+	Kind  string
+	Used  int64
+	Limit int64
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("user %s: daily %s quota exceeded (%d/%d), reset at 00:00 UTC", e.User, e.Kind, e.Used, e.Limit)
+}
+
+// 是否允许访问host
+func (u *User) allowed(host string) bool {
+	if len(u.Domains) == 0 {
+		return true
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	for _, d := range u.Domains {
+		d = strings.ToLower(d)
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// 计数器的key，按天区分，第二天自动使用新的计数器
+func usageKey(name string, kind string) string {
+	return "usage:" + time.Now().UTC().Format("20060102") + ":" + kind + ":" + name
+}
+
+// 增加一次请求，超过请求数或者流量配额时返回QuotaError
+func (u *User) checkQuota(f Fetcher) error {
+	reqs, err := f.AddUsage(usageKey(u.Name, "requests"), 1)
+	if err != nil {
+		// 计数失败时不影响使用
+		f.Warningf("Count usage failed: %v", err)
+		return nil
+	}
+	if u.DailyRequests > 0 && reqs > u.DailyRequests {
+		return &QuotaError{u.Name, "requests", reqs, u.DailyRequests}
+	}
+	if u.DailyBytes > 0 {
+		used, err := f.AddUsage(usageKey(u.Name, "bytes"), 0)
+		if err != nil {
+			f.Warningf("Count usage failed: %v", err)
+			return nil
+		}
+		if used >= u.DailyBytes {
+			return &QuotaError{u.Name, "bytes", used, u.DailyBytes}
+		}
+	}
+	return nil
+}
+
+// 请求完成后记录流量
+func (u *User) addBytes(f Fetcher, n int64) {
+	if n <= 0 {
+		return
+	}
+	if _, err := f.AddUsage(usageKey(u.Name, "bytes"), n); err != nil {
+		f.Warningf("Count usage failed: %v", err)
+	}
+}
@@ -83,6 +83,8 @@ def main():
         println(u'appid 不能包含 ios/android/mobile 等字样。')
         sys.exit(-1)
     os.chdir(os.path.abspath(os.path.dirname(__file__)))
+    # 服务器端引用了client目录下的第三方库
+    os.environ.setdefault('GOPATH', os.path.abspath('client'))
     try:
         os.remove(appengine_rpc.HttpRpcServer.DEFAULT_COOKIE_FILE_PATH)
     except OSError: